@@ -1,43 +1,329 @@
 package client
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp/common"
 )
 
 // Client connects to one or more Server using HTTP websockets
 // The Server can then send HTTP requests to execute
 type Client struct {
-	Config *Config
+	config       atomic.Value // *Config, replaced by Reload
+	poolIdleSize int64        // Pool idle size set by SetPoolIdleSize, 0 to use the configuration
+
+	backend   atomic.Value      // *http.Client executing the backend requests
+	dialer    atomic.Value      // *websocket.Dialer connecting to the Servers
+	transport http.RoundTripper // Transport set by SetTransport if not nil
+	pools     map[string]*Pool
+	lock      sync.Mutex
+
+	healthy int32
+	done    chan struct{}
+
+	reverse       chan *reverseConnection
+	reverseServer *http.Server
+
+	failConnect int32
+	failRequest int32
 
-	client *http.Client
-	dialer *websocket.Dialer
-	pools  map[string]*Pool
+	logger *log.Logger
+
+	connectionID uint64
+	generation   int64
+
+	latency *latencyRecorder
 }
 
 // NewClient creates a new Proxy
 func NewClient(config *Config) (c *Client) {
 	c = new(Client)
-	c.Config = config
-	c.client = &http.Client{}
-	c.dialer = &websocket.Dialer{}
+	c.config.Store(config)
+	c.logger = log.Default()
+	if len(config.RedactQueryParams) > 0 || len(config.RedactPatterns) > 0 {
+		c.logger = log.New(c.redact(log.Writer()), log.Prefix(), log.Flags())
+	}
+	c.generation = time.Now().Unix()
+	c.latency = new(latencyRecorder)
+
+	c.backend.Store(c.newBackend(config))
+	c.dialer.Store(c.newDialer(config))
 	c.pools = make(map[string]*Pool)
+	c.healthy = 1
+	c.done = make(chan struct{})
+	c.reverse = make(chan *reverseConnection, config.PoolIdleSize)
+	return
+}
+
+// newBackend creates the http.Client executing the backend requests according to the configuration
+// This MUST be surrounded by c.lock.Lock() once the Client is created
+func (c *Client) newBackend(config *Config) *http.Client {
+	if c.transport != nil {
+		return &http.Client{Transport: c.transport}
+	}
+
+	// Requests exceeding MaxConnsPerHost wait for a backend connection to be available
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = config.MaxConnsPerHost
+
+	// Prevent the transport from adding an Accept-Encoding header and decompressing the response
+	transport.DisableCompression = config.PreserveHeaders
+
+	// gRPC backends without TLS require HTTP/2 with prior knowledge
+	if config.H2C {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	// Don't share backend connections and limits between destination hosts
+	if config.IsolateBackends {
+		return &http.Client{Transport: newBackendTransport(transport, config.BackendMaxConns)}
+	}
+	return &http.Client{Transport: transport}
+}
+
+// newDialer creates the websocket.Dialer connecting to the Servers according to the configuration
+func (c *Client) newDialer(config *Config) *websocket.Dialer {
+	// Enable TCP keepalive to detect dead Servers behind NATs faster than websocket pings
+	dialer := &net.Dialer{KeepAlive: time.Duration(config.TCPKeepAlive) * time.Millisecond}
+	wsDialer := &websocket.Dialer{NetDial: dialer.Dial, EnableCompression: config.EnableCompression, Subprotocols: config.Protocols}
+
+	// Trust the Servers certificates signed by a private CA
+	tlsConfig, err := config.tlsClientConfig()
+	if err != nil {
+		c.logger.Printf("Unable to load TLS configuration : %s", err)
+	}
+	wsDialer.TLSClientConfig = tlsConfig
+	return wsDialer
+}
+
+// Config returns the current configuration, it is replaced by Reload
+// Load it once per use so that every setting comes from the same configuration.
+// The returned configuration MUST NOT be modified
+func (c *Client) Config() *Config {
+	return c.config.Load().(*Config)
+}
+
+// getBackend returns the http.Client executing the backend requests
+func (c *Client) getBackend() *http.Client {
+	return c.backend.Load().(*http.Client)
+}
+
+// getDialer returns the websocket.Dialer connecting to the Servers
+func (c *Client) getDialer() *websocket.Dialer {
+	return c.dialer.Load().(*websocket.Dialer)
+}
+
+// getPoolIdleSize returns the number of connections to keep idle per Server
+func (c *Client) getPoolIdleSize() int {
+	if size := atomic.LoadInt64(&c.poolIdleSize); size > 0 {
+		return int(size)
+	}
+	return c.Config().PoolIdleSize
+}
+
+// Settings returns the ClientSettings to send to the Server
+func (c *Client) Settings() (settings *common.ClientSettings) {
+	config := c.Config()
+	settings = new(common.ClientSettings)
+	settings.ID = config.ID
+	settings.Name = config.Name
+	settings.PoolSize = c.getPoolIdleSize()
+	settings.MaxBodySize = config.MaxBodySize
+	settings.Checksum = config.Checksum
+	settings.Encoding = config.Encoding
+	settings.Version = common.Version
+	settings.Trailers = config.Trailers
+	settings.NoBody = true
+	settings.Control = true
 	return
 }
 
 // Start the Proxy
 func (c *Client) Start() {
-	for _, target := range c.Config.Targets {
-		pool := NewPool(c, target, c.Config.SecretKey)
-		c.pools[target] = pool
-		go pool.Start()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	config := c.Config()
+	for _, target := range config.Targets {
+		c.startPool(target)
+	}
+
+	if config.HealthCheckURL != "" && config.HealthCheckInterval > 0 {
+		go c.healthCheck()
+	}
+
+	if config.ReverseListen != "" {
+		c.reverseServer = &http.Server{Addr: config.ReverseListen, Handler: http.HandlerFunc(c.reverseRequest), ErrorLog: c.logger}
+		go c.startReverse()
 	}
 }
 
+// healthCheck periodically checks the backend health
+// Connections are closed while the backend is unhealthy so that the Server routes requests elsewhere
+func (c *Client) healthCheck() {
+	interval := time.Duration(c.Config().HealthCheckInterval) * time.Millisecond
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := c.checkBackend(interval)
+		if healthy := err == nil; healthy != c.isHealthy() {
+			if healthy {
+				c.logger.Printf("Backend is healthy again")
+				atomic.StoreInt32(&c.healthy, 1)
+			} else {
+				c.logger.Printf("Backend is unhealthy, closing idle connections : %s", err)
+				atomic.StoreInt32(&c.healthy, 0)
+
+				c.lock.Lock()
+				for _, pool := range c.pools {
+					go pool.closeIdle(common.CloseUnhealthy)
+				}
+				c.lock.Unlock()
+			}
+		}
+
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkBackend returns an error unless the health check URL answers with a status code lower than 400
+func (c *Client) checkBackend(timeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", c.Config().HealthCheckURL, nil)
+	if err != nil {
+		return fmt.Errorf("Invalid health check URL : %s", err)
+	}
+
+	resp, err := c.getBackend().Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("Health check returned %s", resp.Status)
+	}
+	return
+}
+
+// isHealthy returns false if the backend failed its last health check
+func (c *Client) isHealthy() bool {
+	return atomic.LoadInt32(&c.healthy) == 1
+}
+
+// startPool creates and starts a new Pool to the target
+// This MUST be surrounded by c.lock.Lock()
+func (c *Client) startPool(target string) {
+	pool := NewPool(c, target, c.Config().SecretKey)
+	c.pools[target] = pool
+	go pool.Start()
+}
+
+// Reload applies a new configuration
+// Pools are started for new targets and drained for removed targets,
+// pools of unchanged targets keep their connections.
+// The backend transport and the websocket dialer are rebuilt, running requests
+// and open connections keep the previous ones.
+// The client ID, the redaction settings, reverselisten and the health check interval
+// can't be changed by a reload.
+// Open connections keep the encoding, checksum and trailers settings they were registered with.
+// A pool idle size set by SetPoolIdleSize is kept.
+func (c *Client) Reload(config *Config) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	previous := c.Config()
+	config.ID = previous.ID
+	config.RedactQueryParams = previous.RedactQueryParams
+	config.RedactPatterns = previous.RedactPatterns
+	config.ReverseListen = previous.ReverseListen
+	config.HealthCheckInterval = previous.HealthCheckInterval
+	c.config.Store(config)
+
+	// Idle backend connections of the previous transport are not reused anymore
+	backend := c.getBackend()
+	c.backend.Store(c.newBackend(config))
+	backend.CloseIdleConnections()
+	c.dialer.Store(c.newDialer(config))
+
+	targets := make(map[string]bool)
+	for _, target := range config.Targets {
+		targets[target] = true
+		if _, ok := c.pools[target]; !ok {
+			c.logger.Printf("Adding target %s", target)
+			c.startPool(target)
+		}
+	}
+
+	for target, pool := range c.pools {
+		if !targets[target] {
+			c.logger.Printf("Removing target %s", target)
+			delete(c.pools, target)
+			go pool.Drain()
+		}
+	}
+}
+
+// SetPoolIdleSize updates the number of connections to keep idle per Server
+// It overrides the poolidlesize of the configuration, even after a Reload
+func (c *Client) SetPoolIdleSize(size int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.logger.Printf("Setting pool idle size to %d", size)
+	atomic.StoreInt64(&c.poolIdleSize, int64(size))
+	for _, pool := range c.pools {
+		go pool.connector()
+	}
+}
+
+// ServerStats returns the last statistics pushed by each Server by target
+// Servers push them if their statspushinterval is set
+func (c *Client) ServerStats() (stats map[string]*common.ServerStats) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats = make(map[string]*common.ServerStats)
+	for target, pool := range c.pools {
+		if s, ok := pool.serverStats.Load().(*common.ServerStats); ok {
+			stats[target] = s
+		}
+	}
+	return
+}
+
 // Shutdown the Proxy
 func (c *Client) Shutdown() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	close(c.done)
 	for _, pool := range c.pools {
 		pool.Shutdown()
 	}
+
+	if c.reverseServer != nil {
+		c.reverseServer.Close()
+	}
 }
@@ -1,7 +1,9 @@
 package client
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
 
 	"github.com/nu7hatch/gouuid"
 	"gopkg.in/yaml.v2"
@@ -11,13 +13,41 @@ import (
 
 // Config configures an Proxy
 type Config struct {
-	ID           string
-	Targets      []string
-	PoolIdleSize int
-	PoolMaxSize  int
-	Whitelist    []*common.Rule
-	Blacklist    []*common.Rule
-	SecretKey    string
+	ID                   string
+	Name                 string
+	Targets              []string
+	PoolIdleSize         int
+	PoolMaxSize          int
+	MaxConnsPerHost      int
+	IsolateBackends      bool
+	BackendMaxConns      map[string]int
+	MaxBodySize          int64
+	PreserveHeaders      bool
+	Checksum             bool
+	BufferResponseSize   int64
+	BufferRequestSize    int64
+	HealthCheckURL       string
+	HealthCheckInterval  int
+	CloseTimeout         int
+	BodyReadTimeout      int
+	Encoding             string
+	ReverseListen        string
+	TCPKeepAlive         int
+	Trailers             bool
+	H2C                  bool
+	EnableCompression    bool
+	CompressionMinSize   int64
+	CompressionSkipTypes []string
+	Protocols            []string
+	Whitelist            []*common.Rule
+	Blacklist            []*common.Rule
+	SecretKey            string
+	RedactQueryParams    []string
+	RedactPatterns       []string
+	CACertFile           string
+	InsecureSkipVerify   bool
+	TLSCertFile          string
+	TLSKeyFile           string
 }
 
 // NewConfig creates a new ProxyConfig
@@ -29,10 +59,16 @@ func NewConfig() (config *Config) {
 		panic(err)
 	}
 	config.ID = id.String()
+	config.Name, _ = os.Hostname()
 
 	config.Targets = []string{"ws://127.0.0.1:8080/register"}
 	config.PoolIdleSize = 10
 	config.PoolMaxSize = 100
+	config.HealthCheckInterval = 10000
+	config.Encoding = common.JSONEncoding
+	config.CompressionMinSize = 1024
+	config.CompressionSkipTypes = common.DefaultCompressionSkipTypes
+	config.Protocols = common.Protocols
 
 	config.Whitelist = make([]*common.Rule, 0)
 	config.Blacklist = make([]*common.Rule, 0)
@@ -54,6 +90,23 @@ func LoadConfiguration(path string) (config *Config, err error) {
 		return
 	}
 
+	if !common.IsValidEncoding(config.Encoding) {
+		err = fmt.Errorf("Invalid encoding %s", config.Encoding)
+		return
+	}
+
+	if err = common.ValidateProtocols(config.Protocols); err != nil {
+		return
+	}
+
+	if _, err = config.tlsClientConfig(); err != nil {
+		return
+	}
+
+	if _, err = common.NewRedactor(nil, config.RedactQueryParams, config.RedactPatterns); err != nil {
+		return
+	}
+
 	// Compile the rules
 
 	for _, rule := range config.Whitelist {
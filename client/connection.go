@@ -1,13 +1,14 @@
 package client
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -15,6 +16,9 @@ import (
 	"github.com/root-gg/wsp/common"
 )
 
+// greetingAckTimeout is the maximum time to wait for the Server to acknowledge the greeting message
+const greetingAckTimeout = 10 * time.Second
+
 // Status of a Connection
 const (
 	CONNECTING = iota
@@ -24,38 +28,83 @@ const (
 
 // Connection handle a single websocket (HTTP/TCP) connection to an Server
 type Connection struct {
-	pool   *Pool
-	ws     *websocket.Conn
-	status int
+	id       uint64
+	pool     *Pool
+	ws       *websocket.Conn
+	protocol string
+	settings *common.ClientSettings // Settings sent in the greeting message, a reload doesn't change them
+	status   int32 // Accessed atomically, see getStatus()
+	readDone chan struct{}
+	closed   bool
+	noBody   bool // The current request has no body message
 }
 
 // NewConnection create a Connection object
 func NewConnection(pool *Pool) (conn *Connection) {
 	conn = new(Connection)
+	conn.id = atomic.AddUint64(&pool.client.connectionID, 1)
 	conn.pool = pool
-	conn.status = CONNECTING
+	conn.setStatus(CONNECTING)
+	conn.readDone = make(chan struct{})
 	return
 }
 
+// getStatus returns the status of the connection
+func (connection *Connection) getStatus() int32 {
+	return atomic.LoadInt32(&connection.status)
+}
+
+// setStatus changes the status of the connection
+func (connection *Connection) setStatus(status int32) {
+	atomic.StoreInt32(&connection.status, status)
+}
+
 // Connect to the IsolatorServer using a HTTP websocket
 func (connection *Connection) Connect() (err error) {
-	log.Printf("Connecting to %s", connection.pool.target)
+	connection.logf("Connecting")
 
-	// Create a new TCP(/TLS) connection ( no use of net.http )
-	connection.ws, _, err = connection.pool.client.dialer.Dial(connection.pool.target, http.Header{"X-SECRET-KEY": {connection.pool.secretKey}})
+	if injectedFailure(&connection.pool.client.failConnect) {
+		return errors.New("Injected connection failure")
+	}
 
+	// Create a new TCP(/TLS) connection ( no use of net.http )
+	ws, resp, err := connection.pool.client.getDialer().Dial(connection.pool.target, http.Header{"X-SECRET-KEY": {connection.pool.secretKey}})
 	if err != nil {
+		if err == websocket.ErrBadHandshake && resp != nil {
+			return fmt.Errorf("%s : %s", err, resp.Status)
+		}
 		return err
 	}
+	connection.ws = ws
+
+	// Servers that don't select a subprotocol speak wsp.v1
+	connection.protocol = common.NegotiatedProtocol(ws.Subprotocol())
+	if !common.HasProtocol(connection.pool.client.Config().Protocols, connection.protocol) {
+		connection.Close(common.CloseProtocol)
+		return fmt.Errorf("Unsupported protocol %s", connection.protocol)
+	}
+
+	connection.logf("Connected ( protocol %s )", connection.protocol)
 
-	log.Printf("Connected to %s", connection.pool.target)
+	// Send the greeting message with proxy id, wanted pool size and max body size.
+	// The Server frames the messages of this connection according to these settings
+	connection.settings = connection.pool.client.Settings()
+	greeting, err := json.Marshal(connection.settings)
+	if err != nil {
+		connection.logf("Greeting error : %s", err)
+		connection.Close(common.CloseError)
+		return
+	}
+	err = connection.ws.WriteMessage(websocket.TextMessage, greeting)
+	if err != nil {
+		connection.logf("Greeting error : %s", err)
+		connection.Close(common.CloseError)
+		return
+	}
 
-	// Send the greeting message with proxy id and wanted pool size.
-	greeting := fmt.Sprintf("%s_%d", connection.pool.client.Config.ID, connection.pool.client.Config.PoolIdleSize)
-	err = connection.ws.WriteMessage(websocket.TextMessage, []byte(greeting))
+	err = readGreetingAck(connection.ws)
 	if err != nil {
-		log.Println("greeting error :", err)
-		connection.Close()
+		connection.Close(common.CloseProtocol)
 		return
 	}
 
@@ -64,6 +113,29 @@ func (connection *Connection) Connect() (err error) {
 	return
 }
 
+// readGreetingAck waits for the Server to accept the greeting message ( wsp.v2 )
+// Servers speaking wsp.v1 don't acknowledge the greeting message
+func readGreetingAck(ws *websocket.Conn) (err error) {
+	if common.NegotiatedProtocol(ws.Subprotocol()) == common.ProtocolV1 {
+		return
+	}
+
+	ws.SetReadDeadline(time.Now().Add(greetingAckTimeout))
+	defer ws.SetReadDeadline(time.Time{})
+
+	mt, ack, err := ws.ReadMessage()
+	if err != nil {
+		if closeErr, ok := err.(*websocket.CloseError); ok {
+			return fmt.Errorf("Greeting rejected by the Server : %s", closeErr.Text)
+		}
+		return fmt.Errorf("Unable to read greeting acknowledgment : %s", err)
+	}
+	if mt != websocket.TextMessage || string(ack) != common.GreetingAck {
+		return errors.New("Invalid greeting acknowledgment")
+	}
+	return
+}
+
 // the main loop it :
 //  - wait to receive HTTP requests from the Server
 //  - execute HTTP requests
@@ -72,7 +144,9 @@ func (connection *Connection) Connect() (err error) {
 // As in the server code there is no buffering of HTTP request/response body
 // As is the server if any error occurs the connection is closed/throwed
 func (connection *Connection) serve() {
-	defer connection.Close()
+	reason := common.CloseError
+	defer func() { connection.Close(reason) }()
+	defer close(connection.readDone)
 
 	// Keep connection alive
 	go func() {
@@ -80,63 +154,110 @@ func (connection *Connection) serve() {
 			time.Sleep(30 * time.Second)
 			err := connection.ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(time.Second))
 			if err != nil {
-				connection.Close()
+				connection.Close(common.CloseError)
+				return
 			}
 		}
 	}()
 
 	for {
+		// Stop serving requests once the pool is drained or while the backend is unhealthy
+		if connection.pool.isDone() {
+			reason = common.CloseShutdown
+			break
+		}
+		if !connection.pool.client.isHealthy() {
+			reason = common.CloseUnhealthy
+			break
+		}
+
 		// Read request
-		connection.status = IDLE
-		_, jsonRequest, err := connection.ws.ReadMessage()
+		connection.setStatus(IDLE)
+		_, serializedRequest, err := connection.ws.ReadMessage()
 		if err != nil {
-			log.Println("Unable to read request", err)
+			if _, ok := err.(*websocket.CloseError); ok {
+				reason = common.ClosePeer
+			}
+			connection.logf("Unable to read request : %s", err)
 			break
 		}
 
-		connection.status = RUNNING
+		connection.setStatus(RUNNING)
 
 		// Trigger a pool refresh to open new connections if needed
 		go connection.pool.connector()
 
 		// Deserialize request
 		httpRequest := new(common.HTTPRequest)
-		err = json.Unmarshal(jsonRequest, httpRequest)
+		err = common.Unmarshal(connection.settings.Encoding, serializedRequest, httpRequest)
 		if err != nil {
-			connection.error(fmt.Sprintf("Unable to deserialize json http request : %s\n", err))
+			connection.error(fmt.Sprintf("Unable to deserialize http request : %s\n", err))
+			reason = common.CloseProtocol
 			break
 		}
 
+		connection.noBody = httpRequest.NoBody
+
 		req, err := common.UnserializeHTTPRequest(httpRequest)
 		if err != nil {
 			connection.error(fmt.Sprintf("Unable to deserialize http request : %v\n", err))
+			reason = common.CloseProtocol
+			break
+		}
+
+		connection.logf("[%s] %s", req.Method, req.URL.String())
+
+		if injectedFailure(&connection.pool.client.failRequest) {
+			err = connection.discard()
+			if err == nil {
+				connection.error("Injected request failure\n")
+			}
 			break
 		}
 
-		log.Printf("[%s] %s", req.Method, req.URL.String())
+		// Handle control requests from the Server
+		if req.URL.Scheme == common.ControlScheme {
+			err = connection.discard()
+			if err != nil {
+				break
+			}
+			err = connection.control(req)
+			if err != nil {
+				break
+			}
+			continue
+		}
+
+		// The configuration may be replaced by a reload while the request is served
+		config := connection.pool.client.Config()
 
 		// Apply blacklist
-		if len(connection.pool.client.Config.Blacklist) > 0 {
-			for _, rule := range connection.pool.client.Config.Blacklist {
+		if len(config.Blacklist) > 0 {
+			forbidden := false
+			for _, rule := range config.Blacklist {
 				if rule.Match(req) {
-					// Discard request body
-					err = connection.discard()
-					if err != nil {
-						break
-					}
-					err = connection.error("Destination is forbidden")
-					if err != nil {
-						break
-					}
-					continue
+					forbidden = true
+					break
 				}
 			}
+			if forbidden {
+				// Discard request body
+				err = connection.discard()
+				if err != nil {
+					break
+				}
+				err = connection.error("Destination is forbidden\n")
+				if err != nil {
+					break
+				}
+				continue
+			}
 		}
 
 		// Apply whitelist
-		if len(connection.pool.client.Config.Whitelist) > 0 {
+		if len(config.Whitelist) > 0 {
 			allowed := false
-			for _, rule := range connection.pool.client.Config.Whitelist {
+			for _, rule := range config.Whitelist {
 				if rule.Match(req) {
 					allowed = true
 					break
@@ -156,16 +277,63 @@ func (connection *Connection) serve() {
 			}
 		}
 
+		// Check request body size
+		if config.MaxBodySize > 0 && req.ContentLength > config.MaxBodySize {
+			// Discard request body
+			err = connection.discard()
+			if err != nil {
+				break
+			}
+			err = connection.error("Request body is too large\n")
+			if err != nil {
+				break
+			}
+			continue
+		}
+
 		// Pipe request body
-		_, bodyReader, err := connection.ws.NextReader()
-		if err != nil {
-			log.Printf("Unable to get response body reader : %v", err)
-			break
+		if connection.noBody {
+			req.Body = http.NoBody
+		} else {
+			_, bodyReader, err := connection.ws.NextReader()
+			if err != nil {
+				connection.logf("Unable to get response body reader : %v", err)
+				break
+			}
+			if connection.settings.Checksum {
+				bodyReader = common.NewChecksumReader(bodyReader)
+			}
+			req.Body = ioutil.NopCloser(bodyReader)
+
+			// Don't send empty bodies as chunked requests
+			if req.ContentLength == 0 {
+				req.Body = http.NoBody
+			}
+		}
+
+		// Buffer small chunked requests to send an accurate Content-Length to the backend
+		if req.ContentLength < 0 && config.BufferRequestSize > 0 {
+			err = bufferRequest(req, config.BufferRequestSize)
+			if err != nil {
+				err = connection.error(fmt.Sprintf("Unable to read request body : %v\n", err))
+				if err != nil {
+					break
+				}
+				continue
+			}
+		}
+
+		// Prevent the http client from adding a default User-Agent header
+		if config.PreserveHeaders && req.Header.Get("User-Agent") == "" {
+			req.Header.Set("User-Agent", "")
 		}
-		req.Body = ioutil.NopCloser(bodyReader)
 
 		// Execute request
-		resp, err := connection.pool.client.client.Do(req)
+		start := time.Now()
+		resp, err := connection.pool.client.getBackend().Do(connection.withConnectionInfo(req))
+		if err == nil {
+			connection.pool.client.latency.record(time.Since(start))
+		}
 		if err != nil {
 			err = connection.error(fmt.Sprintf("Unable to execute request : %v\n", err))
 			if err != nil {
@@ -174,8 +342,25 @@ func (connection *Connection) serve() {
 			continue
 		}
 
+		// Abort the response when the backend stalls mid-body
+		if timeout := config.BodyReadTimeout; timeout > 0 {
+			resp.Body = newIdleTimeoutBody(resp.Body, time.Duration(timeout)*time.Millisecond)
+		}
+
+		// Buffer small chunked responses to send an accurate Content-Length
+		if resp.ContentLength < 0 && config.BufferResponseSize > 0 {
+			err = bufferResponse(resp, config.BufferResponseSize)
+			if err != nil {
+				err = connection.error(fmt.Sprintf("Unable to read response : %v\n", err))
+				if err != nil {
+					break
+				}
+				continue
+			}
+		}
+
 		// Serialize response
-		jsonResponse, err := json.Marshal(common.SerializeHTTPResponse(resp))
+		serializedResponse, err := common.Marshal(connection.settings.Encoding, common.SerializeHTTPResponse(resp))
 		if err != nil {
 			err = connection.error(fmt.Sprintf("Unable to serialize response : %v\n", err))
 			if err != nil {
@@ -185,64 +370,153 @@ func (connection *Connection) serve() {
 		}
 
 		// Write response
-		err = connection.ws.WriteMessage(websocket.TextMessage, jsonResponse)
+		err = connection.ws.WriteMessage(common.MessageType(connection.settings.Encoding), serializedResponse)
 		if err != nil {
-			log.Printf("Unable to write response : %v", err)
+			connection.logf("Unable to write response : %v", err)
 			break
 		}
 
-		// Pipe response body
-		bodyWriter, err := connection.ws.NextWriter(websocket.BinaryMessage)
+		// Pipe response body, don't compress small or already compressed bodies
+		connection.ws.EnableWriteCompression(common.Compressible(resp.Header.Get("Content-Type"), resp.ContentLength, config.CompressionMinSize, config.CompressionSkipTypes))
+		bodyWriter, err := connection.nextBodyWriter()
+		connection.ws.EnableWriteCompression(true)
 		if err != nil {
-			log.Printf("Unable to get response body writer : %v", err)
+			connection.logf("Unable to get response body writer : %v", err)
 			break
 		}
 		_, err = io.Copy(bodyWriter, resp.Body)
 		if err != nil {
-			log.Printf("Unable to get pipe response body : %v", err)
+			connection.logf("Unable to get pipe response body : %v", err)
+
+			// Notify the Server that the response body is truncated
+			reason := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "Truncated response body")
+			connection.ws.WriteControl(websocket.CloseMessage, reason, time.Now().Add(time.Second))
 			break
 		}
 		bodyWriter.Close()
+
+		// Write response trailers, they are only known once the body has been read
+		err = connection.writeTrailer(resp.Trailer)
+		if err != nil {
+			break
+		}
 	}
 }
 
 func (connection *Connection) error(msg string) (err error) {
-	resp := common.NewHTTPResponse()
-	resp.StatusCode = 527
-
-	log.Println(msg)
+	connection.logf("%s", msg)
+	return connection.respond(527, msg)
+}
 
+// respond sends a response with the message as body to the Server
+func (connection *Connection) respond(status int, msg string) (err error) {
+	resp := common.NewHTTPResponse()
+	resp.StatusCode = status
 	resp.ContentLength = int64(len(msg))
 
 	// Serialize response
-	jsonResponse, err := json.Marshal(resp)
+	serializedResponse, err := common.Marshal(connection.settings.Encoding, resp)
 	if err != nil {
-		log.Printf("Unable to serialize response : %v", err)
+		connection.logf("Unable to serialize response : %v", err)
 		return
 	}
 
 	// Write response
-	err = connection.ws.WriteMessage(websocket.TextMessage, jsonResponse)
+	err = connection.ws.WriteMessage(common.MessageType(connection.settings.Encoding), serializedResponse)
 	if err != nil {
-		log.Printf("Unable to write response : %v", err)
+		connection.logf("Unable to write response : %v", err)
 		return
 	}
 
 	// Write response body
-	err = connection.ws.WriteMessage(websocket.BinaryMessage, []byte(msg))
+	bodyWriter, err := connection.nextBodyWriter()
+	if err != nil {
+		connection.logf("Unable to get response body writer : %v", err)
+		return
+	}
+	_, err = bodyWriter.Write([]byte(msg))
+	if err != nil {
+		connection.logf("Unable to write response body : %v", err)
+		return
+	}
+	err = bodyWriter.Close()
+	if err != nil {
+		connection.logf("Unable to write response body (close) : %v", err)
+		return
+	}
+
+	return connection.writeTrailer(nil)
+}
+
+// writeTrailer sends the response trailers to the Server if trailers are forwarded
+func (connection *Connection) writeTrailer(header http.Header) (err error) {
+	if !connection.settings.Trailers {
+		return
+	}
+
+	serializedTrailer, err := common.Marshal(connection.settings.Encoding, &common.HTTPTrailer{Header: header})
 	if err != nil {
-		log.Printf("Unable to write response body : %v", err)
+		connection.logf("Unable to serialize response trailer : %v", err)
 		return
 	}
+	err = connection.ws.WriteMessage(common.MessageType(connection.settings.Encoding), serializedTrailer)
+	if err != nil {
+		connection.logf("Unable to write response trailer : %v", err)
+		return
+	}
+	return
+}
 
+// Get a writer for the next response body message
+func (connection *Connection) nextBodyWriter() (writer io.WriteCloser, err error) {
+	writer, err = connection.ws.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return
+	}
+	if connection.settings.Checksum {
+		writer = common.NewChecksumWriter(writer)
+	}
+	return
+}
+
+// Buffer at most size bytes of the response body
+// If the whole body has been buffered the response ContentLength is set accordingly
+func bufferResponse(resp *http.Response, size int64) (err error) {
+	buffer, err := ioutil.ReadAll(io.LimitReader(resp.Body, size+1))
+	if err != nil {
+		return
+	}
+	if int64(len(buffer)) <= size {
+		resp.ContentLength = int64(len(buffer))
+	}
+	resp.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(buffer), resp.Body))
+	return
+}
+
+// Buffer at most size bytes of the request body
+// If the whole body has been buffered the request ContentLength is set accordingly
+func bufferRequest(req *http.Request, size int64) (err error) {
+	buffer, err := ioutil.ReadAll(io.LimitReader(req.Body, size+1))
+	if err != nil {
+		return
+	}
+	if int64(len(buffer)) <= size {
+		req.ContentLength = int64(len(buffer))
+		req.Body = ioutil.NopCloser(bytes.NewReader(buffer))
+		return
+	}
+	req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(buffer), req.Body))
 	return
 }
 
 // Discard request body
 func (connection *Connection) discard() (err error) {
+	if connection.noBody {
+		return
+	}
 	mt, _, err := connection.ws.NextReader()
 	if err != nil {
-		return nil
+		return
 	}
 	if mt != websocket.BinaryMessage {
 		return errors.New("Invalid body message type")
@@ -251,10 +525,21 @@ func (connection *Connection) discard() (err error) {
 }
 
 // Close close the ws/tcp connection and remove it from the pool
-func (connection *Connection) Close() {
+func (connection *Connection) Close(reason common.CloseReason) {
 	connection.pool.lock.Lock()
 	defer connection.pool.lock.Unlock()
 
+	if connection.closed {
+		return
+	}
+	connection.closed = true
+
+	connection.logf("Closing connection : %s", reason)
+
 	connection.pool.remove(connection)
-	connection.ws.Close()
+
+	// Close the websocket gracefully then the underlying TCP connection
+	if connection.ws != nil {
+		go common.CloseWebsocket(connection.ws, connection.readDone)
+	}
 }
@@ -0,0 +1,43 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// ConnectionInfo describes the websocket connection a backend request has been received from
+type ConnectionInfo struct {
+	PoolID       string // Client id, the Server pools the connections by this id
+	Target       string // Server the connection is connected to
+	ConnectionID uint64 // Unique id of the connection within the Client
+}
+
+type connectionInfoKey struct{}
+
+// ConnectionInfoFromContext returns the connection info of a backend request
+// context, it is nil if the request has not been received from a Server
+func ConnectionInfoFromContext(ctx context.Context) *ConnectionInfo {
+	info, _ := ctx.Value(connectionInfoKey{}).(*ConnectionInfo)
+	return info
+}
+
+// withConnectionInfo adds the connection info to the backend request context
+func (connection *Connection) withConnectionInfo(req *http.Request) *http.Request {
+	info := &ConnectionInfo{
+		PoolID:       connection.pool.client.Config().ID,
+		Target:       connection.pool.target,
+		ConnectionID: connection.id,
+	}
+	return req.WithContext(context.WithValue(req.Context(), connectionInfoKey{}, info))
+}
+
+// SetTransport replaces the transport executing the backend requests, for example
+// to serve them with an in-process handler, it must be called before Start
+// The transport settings of the configuration ( maxconnsperhost, h2c, ... ) are not applied
+func (c *Client) SetTransport(transport http.RoundTripper) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.transport = transport
+	c.backend.Store(c.newBackend(c.Config()))
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/root-gg/wsp/common"
+)
+
+// control handles a control request sent by the Server
+func (connection *Connection) control(req *http.Request) error {
+	switch req.URL.Path {
+	case "/pool":
+		size, err := strconv.Atoi(req.URL.Query().Get("idlesize"))
+		if err != nil || size <= 0 {
+			return connection.respond(http.StatusBadRequest, "Invalid idlesize\n")
+		}
+		connection.pool.client.SetPoolIdleSize(size)
+		return connection.respond(http.StatusOK, "ok\n")
+	case "/latency":
+		report, err := json.Marshal(connection.pool.client.latency.report())
+		if err != nil {
+			return connection.respond(http.StatusInternalServerError, fmt.Sprintf("Unable to serialize latency report : %s\n", err))
+		}
+		return connection.respond(http.StatusOK, string(report))
+	case "/stats":
+		query := req.URL.Query()
+		stats := &common.ServerStats{Time: time.Now()}
+		stats.Idle, _ = strconv.Atoi(query.Get("idle"))
+		stats.Busy, _ = strconv.Atoi(query.Get("busy"))
+		stats.Requests, _ = strconv.ParseInt(query.Get("requests"), 10, 64)
+		stats.RequestRate, _ = strconv.ParseFloat(query.Get("rate"), 64)
+		connection.pool.serverStats.Store(stats)
+		return connection.respond(http.StatusOK, "ok\n")
+	default:
+		return connection.respond(http.StatusNotFound, "Unknown control request\n")
+	}
+}
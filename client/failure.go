@@ -0,0 +1,23 @@
+package client
+
+import (
+	"sync/atomic"
+)
+
+// Failure injection hooks to exercise the reconnection, retry and circuit breaking logic in tests
+// They have no effect unless armed and each arming triggers a single failure.
+
+// FailNextConnect makes the next connection attempt to a Server fail
+func (c *Client) FailNextConnect() {
+	atomic.StoreInt32(&c.failConnect, 1)
+}
+
+// FailNextRequest makes the next request from a Server fail with a 527 error and closes its connection
+func (c *Client) FailNextRequest() {
+	atomic.StoreInt32(&c.failRequest, 1)
+}
+
+// injectedFailure returns true once after the failure has been armed
+func injectedFailure(armed *int32) bool {
+	return atomic.CompareAndSwapInt32(armed, 1, 0)
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTCPKeepAlive(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		ws.ReadMessage()
+		ws.Close()
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.TCPKeepAlive = 7000
+	c := NewClient(config)
+	c.SetLogOutput(ioutil.Discard)
+
+	ws, _, err := c.getDialer().Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Unable to dial server : %s", err)
+	}
+	defer ws.Close()
+
+	rawConn, err := ws.UnderlyingConn().(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("Unable to get raw connection : %s", err)
+	}
+	var enabled, idle int
+	var errEnabled, errIdle error
+	err = rawConn.Control(func(fd uintptr) {
+		enabled, errEnabled = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		idle, errIdle = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	})
+	for _, err := range []error{err, errEnabled, errIdle} {
+		if err != nil {
+			t.Fatalf("Unable to get socket options : %s", err)
+		}
+	}
+
+	if enabled == 0 {
+		t.Fatal("TCP keepalive is not enabled on dialed connections")
+	}
+	if idle != 7 {
+		t.Fatalf("Unexpected TCP keepalive idle time %ds", idle)
+	}
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/root-gg/wsp/common"
+)
+
+// latencySamples is the number of recent backend request durations the percentiles are computed from
+const latencySamples = 1000
+
+// latencyRecorder keeps the duration of the recent backend requests
+type latencyRecorder struct {
+	samples []time.Duration
+	next    int
+	lock    sync.Mutex
+}
+
+// record adds the duration of a backend request, the oldest one is replaced once full
+func (lr *latencyRecorder) record(duration time.Duration) {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+
+	if len(lr.samples) < latencySamples {
+		lr.samples = append(lr.samples, duration)
+		return
+	}
+	lr.samples[lr.next] = duration
+	lr.next = (lr.next + 1) % latencySamples
+}
+
+// report computes the percentiles of the recorded durations
+func (lr *latencyRecorder) report() (report *common.LatencyReport) {
+	lr.lock.Lock()
+	samples := make([]time.Duration, len(lr.samples))
+	copy(samples, lr.samples)
+	lr.lock.Unlock()
+
+	report = new(common.LatencyReport)
+	report.Samples = len(samples)
+	if len(samples) == 0 {
+		return
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	percentile := func(p int) int64 {
+		return int64(samples[(len(samples)-1)*p/100] / time.Millisecond)
+	}
+	report.P50 = percentile(50)
+	report.P90 = percentile(90)
+	report.P99 = percentile(99)
+	return
+}
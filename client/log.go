@@ -0,0 +1,55 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/root-gg/wsp/common"
+)
+
+// SetLogOutput sends the Client logs to the writer instead of the standard logger
+// ( a file with its own rotation, a syslog writer, ... ), it must be called before Start
+func (c *Client) SetLogOutput(w io.Writer) {
+	c.logger = log.New(c.redact(w), "", log.LstdFlags)
+}
+
+// redact wraps the log output to redact Config.RedactQueryParams and Config.RedactPatterns
+func (c *Client) redact(w io.Writer) io.Writer {
+	config := c.Config()
+	if len(config.RedactQueryParams) == 0 && len(config.RedactPatterns) == 0 {
+		return w
+	}
+	redactor, err := common.NewRedactor(w, config.RedactQueryParams, config.RedactPatterns)
+	if err != nil {
+		log.Printf("Unable to redact logs : %s", err)
+		return w
+	}
+	return redactor
+}
+
+// proxyError log error and return a HTTP 526 error with the message
+func (c *Client) proxyError(w http.ResponseWriter, err error) {
+	c.proxyErrorStatus(w, 526, err)
+}
+
+// proxyErrorf log error and return a HTTP 526 error with the message
+func (c *Client) proxyErrorf(w http.ResponseWriter, format string, args ...interface{}) {
+	c.proxyError(w, fmt.Errorf(format, args...))
+}
+
+// proxyErrorStatus log error and return a HTTP error with the status code and the message
+func (c *Client) proxyErrorStatus(w http.ResponseWriter, status int, err error) {
+	c.logger.Println(err)
+	http.Error(w, err.Error(), status)
+}
+
+// logf logs a message prefixed with the tuple identifying the connection, the generation
+// is the Client creation time so that connection ids are unique across restarts
+func (connection *Connection) logf(format string, args ...interface{}) {
+	c := connection.pool.client
+	config := c.Config()
+	prefix := fmt.Sprintf("[target=%s pool=%s name=%s connection=%d generation=%d] ", connection.pool.target, config.ID, config.Name, connection.id, c.generation)
+	c.logger.Printf(prefix+format, args...)
+}
@@ -2,9 +2,11 @@ package client
 
 import (
 	"fmt"
-	"log"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/root-gg/wsp/common"
 )
 
 // Pool manage a pool of connection to a remote Server
@@ -16,6 +18,8 @@ type Pool struct {
 	connections []*Connection
 	lock        sync.RWMutex
 
+	serverStats atomic.Value // Last *common.ServerStats pushed by the Server
+
 	done chan struct{}
 }
 
@@ -38,7 +42,7 @@ func (pool *Pool) Start() {
 		for {
 			select {
 			case <-pool.done:
-				break
+				return
 			case <-ticker:
 				pool.connector()
 			}
@@ -51,12 +55,17 @@ func (pool *Pool) connector() {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
 
+	// Don't open new connections once the pool is shut down or while the backend is unhealthy
+	if pool.isDone() || !pool.client.isHealthy() {
+		return
+	}
+
 	poolSize := pool.Size()
 
 	//log.Printf("%s pool size : %v", pool.target, poolSize)
 
-	// Create enough connection to fill the pool
-	toCreate := pool.client.Config.PoolIdleSize - poolSize.idle
+	// Create enough connection to fill the pool ( connecting ones will soon be idle )
+	toCreate := pool.client.getPoolIdleSize() - poolSize.idle - poolSize.connecting
 
 	// Create only one connection if the pool is empty
 	if poolSize.total == 0 {
@@ -64,8 +73,8 @@ func (pool *Pool) connector() {
 	}
 
 	// Ensure to open at most PoolMaxSize connections
-	if poolSize.total+toCreate > pool.client.Config.PoolMaxSize {
-		toCreate = pool.client.Config.PoolMaxSize - poolSize.total
+	if max := pool.client.Config().PoolMaxSize; poolSize.total+toCreate > max {
+		toCreate = max - poolSize.total
 	}
 
 	//log.Printf("%v",toCreate)
@@ -78,7 +87,7 @@ func (pool *Pool) connector() {
 		go func() {
 			err := conn.Connect()
 			if err != nil {
-				log.Printf("Unable to connect to %s : %s", pool.target, err)
+				conn.logf("Unable to connect : %s", err)
 
 				pool.lock.Lock()
 				defer pool.lock.Unlock()
@@ -107,11 +116,63 @@ func (pool *Pool) remove(conn *Connection) {
 	pool.connections = filtered
 }
 
+// isDone returns true if the pool has been shut down or drained
+func (pool *Pool) isDone() bool {
+	select {
+	case <-pool.done:
+		return true
+	default:
+		return false
+	}
+}
+
 // Shutdown close all connection in the pool
 func (pool *Pool) Shutdown() {
 	close(pool.done)
 	for _, conn := range pool.connections {
-		conn.Close()
+		conn.Close(common.CloseShutdown)
+	}
+}
+
+// Drain stops opening new connections and closes idle connections,
+// running connections are closed once their current request is done
+// or after Config.CloseTimeout if their request takes longer
+func (pool *Pool) Drain() {
+	pool.lock.Lock()
+	close(pool.done)
+	pool.lock.Unlock()
+
+	pool.closeIdle(common.CloseShutdown)
+
+	timeout := pool.client.Config().CloseTimeout
+	if timeout > 0 {
+		time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+			pool.lock.Lock()
+			connections := make([]*Connection, len(pool.connections))
+			copy(connections, pool.connections)
+			pool.lock.Unlock()
+
+			for _, conn := range connections {
+				if conn.getStatus() == RUNNING {
+					conn.logf("Request still running after close timeout")
+				}
+				conn.Close(common.CloseShutdown)
+			}
+		})
+	}
+}
+
+// closeIdle closes the idle connections of the pool
+func (pool *Pool) closeIdle(reason common.CloseReason) {
+	pool.lock.Lock()
+	connections := make([]*Connection, len(pool.connections))
+	copy(connections, pool.connections)
+	pool.lock.Unlock()
+
+	for _, conn := range connections {
+		if conn.getStatus() == IDLE {
+			conn.Close(reason)
+		}
 	}
 }
 
@@ -132,7 +193,7 @@ func (pool *Pool) Size() (poolSize *PoolSize) {
 	poolSize = new(PoolSize)
 	poolSize.total = len(pool.connections)
 	for _, connection := range pool.connections {
-		switch connection.status {
+		switch connection.getStatus() {
 		case CONNECTING:
 			poolSize.connecting++
 		case IDLE:
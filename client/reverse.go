@@ -0,0 +1,203 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp/common"
+)
+
+// reverseConnection is a websocket connection carrying reverse requests
+type reverseConnection struct {
+	ws       *websocket.Conn
+	settings *common.ClientSettings // Settings sent in the greeting message
+}
+
+// startReverse serves HTTP requests to execute on the Server network on Config.ReverseListen
+// Requests are sent to the first target over dedicated reverse connections
+func (c *Client) startReverse() {
+	c.logger.Printf("Listening for reverse requests on %s", c.Config().ReverseListen)
+
+	err := c.reverseServer.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		c.logger.Printf("Unable to serve reverse requests : %s", err)
+	}
+}
+
+// reverseRequest executes a HTTP request through the Server
+// The destination is set in the X-PROXY-DESTINATION header like for Server requests
+func (c *Client) reverseRequest(w http.ResponseWriter, r *http.Request) {
+	// Parse destination URL
+	dstURL := r.Header.Get("X-PROXY-DESTINATION")
+	if dstURL == "" {
+		c.proxyErrorf(w, "Missing X-PROXY-DESTINATION header")
+		return
+	}
+	URL, err := url.Parse(dstURL)
+	if err != nil {
+		c.proxyErrorf(w, "Unable to parse X-PROXY-DESTINATION header")
+		return
+	}
+	r.URL = URL
+
+	c.logger.Printf("[%s] %s (reverse)", r.Method, r.URL.String())
+
+	rc, err := c.getReverseConnection()
+	if err != nil {
+		c.proxyErrorf(w, "Unable to open reverse connection : %s", err)
+		return
+	}
+
+	err = c.proxyReverseRequest(rc, w, r)
+	if err != nil {
+		// The websocket may be in the middle of a message, never reuse it
+		rc.ws.Close()
+
+		// Response headers have already been sent, abort the response
+		// so that the client doesn't mistake it for a complete one
+		if _, ok := err.(*truncatedResponseError); ok {
+			c.logger.Println(err)
+			panic(http.ErrAbortHandler)
+		}
+		c.proxyError(w, err)
+		return
+	}
+
+	// Keep the connection for the next reverse request
+	select {
+	case c.reverse <- rc:
+	default:
+		rc.ws.Close()
+	}
+}
+
+// getReverseConnection returns an idle reverse connection or opens a new one
+func (c *Client) getReverseConnection() (rc *reverseConnection, err error) {
+	select {
+	case rc = <-c.reverse:
+		return
+	default:
+	}
+
+	config := c.Config()
+	if len(config.Targets) == 0 {
+		return nil, fmt.Errorf("No target")
+	}
+	target := config.Targets[0]
+
+	ws, resp, err := c.getDialer().Dial(target, http.Header{"X-SECRET-KEY": {config.SecretKey}})
+	if err != nil {
+		if err == websocket.ErrBadHandshake && resp != nil {
+			return nil, fmt.Errorf("%s : %s", err, resp.Status)
+		}
+		return
+	}
+
+	// Send the greeting message flagged as reverse
+	settings := c.Settings()
+	settings.Reverse = true
+	greeting, err := json.Marshal(settings)
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	err = ws.WriteMessage(websocket.TextMessage, greeting)
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	err = readGreetingAck(ws)
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+
+	return &reverseConnection{ws: ws, settings: settings}, nil
+}
+
+// proxyReverseRequest sends the request over the reverse connection and pipes the response back
+func (c *Client) proxyReverseRequest(rc *reverseConnection, w http.ResponseWriter, r *http.Request) (err error) {
+	ws := rc.ws
+
+	// Serialize HTTP request
+	serializedRequest, err := common.Marshal(rc.settings.Encoding, common.SerializeHTTPRequest(r))
+	if err != nil {
+		return fmt.Errorf("Unable to serialize request : %s", err)
+	}
+
+	// Send the serialized HTTP request to the Server
+	err = ws.WriteMessage(common.MessageType(rc.settings.Encoding), serializedRequest)
+	if err != nil {
+		return fmt.Errorf("Unable to write request : %s", err)
+	}
+
+	// Pipe the HTTP request body to the Server
+	bodyWriter, err := ws.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return fmt.Errorf("Unable to get request body writer : %s", err)
+	}
+	if rc.settings.Checksum {
+		bodyWriter = common.NewChecksumWriter(bodyWriter)
+	}
+	_, err = io.Copy(bodyWriter, r.Body)
+	if err != nil {
+		return fmt.Errorf("Unable to pipe request body : %s", err)
+	}
+	err = bodyWriter.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to pipe request body (close) : %s", err)
+	}
+
+	// Read the HTTP Response
+	_, serializedResponse, err := ws.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("Unable to read http response : %s", err)
+	}
+	httpResponse := new(common.HTTPResponse)
+	err = common.Unmarshal(rc.settings.Encoding, serializedResponse, httpResponse)
+	if err != nil {
+		return fmt.Errorf("Unable to unserialize http response : %s", err)
+	}
+
+	// Write response headers back to the client
+	for header, values := range httpResponse.Header {
+		for _, value := range values {
+			w.Header().Add(header, value)
+		}
+	}
+	if httpResponse.ContentLength > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(httpResponse.ContentLength, 10))
+	}
+	w.WriteHeader(httpResponse.StatusCode)
+
+	// Pipe the HTTP response body right from the Server to the client
+	_, responseBodyReader, err := ws.NextReader()
+	if err != nil {
+		return &truncatedResponseError{fmt.Errorf("Unable to get reverse response body reader : %s", err)}
+	}
+	if rc.settings.Checksum {
+		responseBodyReader = common.NewChecksumReader(responseBodyReader)
+	}
+	_, err = io.Copy(w, responseBodyReader)
+	if err != nil {
+		return &truncatedResponseError{fmt.Errorf("Unable to pipe reverse response body : %s", err)}
+	}
+
+	return
+}
+
+// truncatedResponseError is returned by proxyReverseRequest when the response
+// body could not be fully piped after the response headers have been sent
+type truncatedResponseError struct {
+	err error
+}
+
+func (e *truncatedResponseError) Error() string {
+	return fmt.Sprintf("Response body truncated : %s", e.err)
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// errBodyReadTimeout is returned when the backend sends no response body data for Config.BodyReadTimeout
+var errBodyReadTimeout = errors.New("Response body read timeout")
+
+// idleTimeoutBody closes the backend response body when a read doesn't return within
+// the timeout so that a stalled body transfer is aborted. Only the time spent waiting
+// for the backend counts, not the time spent writing the body to the websocket.
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration) (b *idleTimeoutBody) {
+	b = &idleTimeoutBody{body: body, timeout: timeout}
+	b.timer = time.AfterFunc(timeout, func() { body.Close() })
+	b.timer.Stop()
+	return
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (n int, err error) {
+	b.timer.Reset(b.timeout)
+	n, err = b.body.Read(p)
+	if !b.timer.Stop() {
+		return n, errBodyReadTimeout
+	}
+	return
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	return b.body.Close()
+}
@@ -0,0 +1,43 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// tlsClientConfig returns the TLS configuration of the wss:// connections to the Servers
+// nil is returned if no TLS setting is set so that the system defaults are used
+func (config *Config) tlsClientConfig() (tlsConfig *tls.Config, err error) {
+	if config.CACertFile == "" && !config.InsecureSkipVerify && config.TLSCertFile == "" && config.TLSKeyFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig = &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+
+	if config.CACertFile != "" {
+		pem, err := ioutil.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read cacertfile : %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate found in cacertfile %s", config.CACertFile)
+		}
+	}
+
+	// Client certificate for Servers requiring mutual TLS
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, fmt.Errorf("Both tlscertfile and tlskeyfile must be set to use a client certificate")
+	}
+	if config.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate : %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return
+}
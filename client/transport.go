@@ -0,0 +1,56 @@
+package client
+
+import (
+	"net/http"
+	"sync"
+)
+
+// backendTransport executes the requests of each backend host with its own
+// http.Transport so that backends don't share connections nor limits
+type backendTransport struct {
+	base       *http.Transport
+	maxConns   map[string]int
+	transports map[string]*http.Transport
+	lock       sync.Mutex
+}
+
+// newBackendTransport creates a backendTransport, the transports of the backend hosts are
+// clones of base, maxConns overrides the MaxConnsPerHost of base for some of them
+func newBackendTransport(base *http.Transport, maxConns map[string]int) (bt *backendTransport) {
+	bt = new(backendTransport)
+	bt.base = base
+	bt.maxConns = maxConns
+	bt.transports = make(map[string]*http.Transport)
+	return
+}
+
+// RoundTrip executes the request with the transport of its host
+func (bt *backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return bt.transport(req.URL.Host).RoundTrip(req)
+}
+
+// transport returns the transport of the host, it is created on first use
+func (bt *backendTransport) transport(host string) *http.Transport {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+
+	transport, ok := bt.transports[host]
+	if !ok {
+		transport = bt.base.Clone()
+		if max, ok := bt.maxConns[host]; ok {
+			transport.MaxConnsPerHost = max
+		}
+		bt.transports[host] = transport
+	}
+	return transport
+}
+
+// CloseIdleConnections closes the idle connections of every backend host
+func (bt *backendTransport) CloseIdleConnections() {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+
+	for _, transport := range bt.transports {
+		transport.CloseIdleConnections()
+	}
+}
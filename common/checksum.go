@@ -0,0 +1,85 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// ChecksumSize is the size of the checksum appended to the body frames
+const ChecksumSize = crc32.Size
+
+// ErrChecksumMismatch is returned when a body frame checksum does not match its content
+var ErrChecksumMismatch = errors.New("Body checksum mismatch")
+
+// ChecksumWriter appends the CRC32 checksum of the written data when closed
+type ChecksumWriter struct {
+	writer io.WriteCloser
+	hash   hash.Hash32
+}
+
+// NewChecksumWriter creates a new ChecksumWriter
+func NewChecksumWriter(writer io.WriteCloser) (cw *ChecksumWriter) {
+	cw = new(ChecksumWriter)
+	cw.writer = writer
+	cw.hash = crc32.NewIEEE()
+	return
+}
+
+// Write data and update the checksum
+func (cw *ChecksumWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.writer.Write(p)
+	cw.hash.Write(p[:n])
+	return
+}
+
+// Close writes the checksum and closes the underlying writer
+func (cw *ChecksumWriter) Close() (err error) {
+	_, err = cw.writer.Write(cw.hash.Sum(nil))
+	if err != nil {
+		return
+	}
+	return cw.writer.Close()
+}
+
+// ChecksumReader strips and verifies the CRC32 checksum at the end of the read data
+type ChecksumReader struct {
+	reader  io.Reader
+	hash    hash.Hash32
+	buffer  []byte
+	pending []byte
+}
+
+// NewChecksumReader creates a new ChecksumReader
+func NewChecksumReader(reader io.Reader) (cr *ChecksumReader) {
+	cr = new(ChecksumReader)
+	cr.reader = reader
+	cr.hash = crc32.NewIEEE()
+	return
+}
+
+// Read data, the last ChecksumSize bytes are held back until EOF to be verified
+func (cr *ChecksumReader) Read(p []byte) (n int, err error) {
+	if len(cr.buffer) < len(p)+ChecksumSize {
+		cr.buffer = make([]byte, len(p)+ChecksumSize)
+	}
+
+	size := copy(cr.buffer, cr.pending)
+	read, err := cr.reader.Read(cr.buffer[size : len(p)+ChecksumSize])
+	size += read
+
+	if size > ChecksumSize {
+		n = copy(p, cr.buffer[:size-ChecksumSize])
+		cr.hash.Write(p[:n])
+	}
+	cr.pending = append(cr.pending[:0], cr.buffer[n:size]...)
+
+	if err == io.EOF {
+		if len(cr.pending) != ChecksumSize || binary.BigEndian.Uint32(cr.pending) != cr.hash.Sum32() {
+			return n, ErrChecksumMismatch
+		}
+	}
+	return
+}
@@ -0,0 +1,18 @@
+package common
+
+// CloseReason classifies why a websocket connection has been closed
+type CloseReason string
+
+// Close reasons
+const (
+	CloseIdleTimeout CloseReason = "idle timeout" // Idle for too long while the pool has enough idle connections
+	CloseRecycled    CloseReason = "recycled"     // Served the maximum number of requests per connection
+	CloseRetired     CloseReason = "retired"      // Retired by an operator through the admin API
+	CloseBusyTimeout CloseReason = "busy timeout" // Busy for longer than the maximum busy time
+	CloseError       CloseReason = "error"        // Unable to read, write or proxy a request
+	CloseProbeFailed CloseReason = "probe failed" // No pong received before using an idle connection
+	CloseProtocol    CloseReason = "protocol"     // Received an unexpected or malformed message
+	ClosePeer        CloseReason = "peer"         // Closed by the other side
+	CloseShutdown    CloseReason = "shutdown"     // The pool has been shut down or drained
+	CloseUnhealthy   CloseReason = "unhealthy"    // The backend failed its health check
+)
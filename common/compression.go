@@ -0,0 +1,29 @@
+package common
+
+import (
+	"mime"
+	"strings"
+)
+
+// DefaultCompressionSkipTypes are content types that are already compressed
+var DefaultCompressionSkipTypes = []string{"image/", "video/", "audio/", "application/zip", "application/gzip", "application/x-gzip", "font/woff2"}
+
+// Compressible returns true if a body is worth compressing
+// Bodies smaller than minSize or whose content type starts with one of skipTypes are not compressed,
+// bodies of unknown length ( -1 ) are compressed unless their content type is skipped.
+func Compressible(contentType string, length int64, minSize int64, skipTypes []string) bool {
+	if length >= 0 && length < minSize {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+	for _, skipType := range skipTypes {
+		if strings.HasPrefix(strings.ToLower(mediaType), strings.ToLower(skipType)) {
+			return false
+		}
+	}
+	return true
+}
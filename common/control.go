@@ -0,0 +1,26 @@
+package common
+
+import "time"
+
+// ControlScheme is the URL scheme of the control requests sent by the Server to the Client
+// Control requests are handled by the Client itself and are never forwarded to a backend
+const ControlScheme = "wsp"
+
+// LatencyReport is the answer of the Client to the latency control request,
+// the percentiles of its recent backend request durations in milliseconds
+type LatencyReport struct {
+	Samples int
+	P50     int64
+	P90     int64
+	P99     int64
+}
+
+// ServerStats are pushed by the Server to the Client with the stats control request,
+// the statistics of the Client pool as seen by the Server
+type ServerStats struct {
+	Idle        int
+	Busy        int
+	Requests    int64   // Requests proxied by the pool
+	RequestRate float64 // Requests per second since the previous push
+	Time        time.Time
+}
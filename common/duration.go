@@ -0,0 +1,35 @@
+package common
+
+import (
+	"fmt"
+	"time"
+)
+
+// Milliseconds is a configuration duration, a number of milliseconds
+// or a time.ParseDuration string like "60s" in the YAML configuration
+type Milliseconds int
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (ms *Milliseconds) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value int
+	if err := unmarshal(&value); err == nil {
+		*ms = Milliseconds(value)
+		return nil
+	}
+
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return fmt.Errorf("Invalid duration %s : %s", str, err)
+	}
+	*ms = Milliseconds(d / time.Millisecond)
+	return nil
+}
+
+// Duration returns the time.Duration
+func (ms Milliseconds) Duration() time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
@@ -0,0 +1,171 @@
+package common
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// Encodings of the HTTPRequest / HTTPResponse messages, negotiated in the greeting message
+const (
+	JSONEncoding   = "json"
+	BinaryEncoding = "binary"
+)
+
+// ErrInvalidBinary is returned when a binary encoded message is malformed
+var ErrInvalidBinary = errors.New("Invalid binary message")
+
+// IsValidEncoding returns true if the encoding is supported
+func IsValidEncoding(enc string) bool {
+	return enc == "" || enc == JSONEncoding || enc == BinaryEncoding
+}
+
+// MessageType returns the websocket message type to use for the encoding
+func MessageType(enc string) int {
+	if enc == BinaryEncoding {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// Marshal serializes a HTTPRequest / HTTPResponse with the encoding ( JSON if empty )
+func Marshal(enc string, v interface{}) ([]byte, error) {
+	switch enc {
+	case "", JSONEncoding:
+		return json.Marshal(v)
+	case BinaryEncoding:
+		if m, ok := v.(encoding.BinaryMarshaler); ok {
+			return m.MarshalBinary()
+		}
+		return nil, fmt.Errorf("%T does not support binary encoding", v)
+	}
+	return nil, fmt.Errorf("Unknown encoding %s", enc)
+}
+
+// Unmarshal unserializes a HTTPRequest / HTTPResponse with the encoding ( JSON if empty )
+// An error is returned if the ContentLength is neither -1 ( unknown ) nor positive
+func Unmarshal(enc string, data []byte, v interface{}) (err error) {
+	err = unmarshal(enc, data, v)
+	if err != nil {
+		return
+	}
+
+	switch m := v.(type) {
+	case *HTTPRequest:
+		err = checkContentLength(m.ContentLength)
+	case *HTTPResponse:
+		err = checkContentLength(m.ContentLength)
+	}
+	return
+}
+
+func unmarshal(enc string, data []byte, v interface{}) error {
+	switch enc {
+	case "", JSONEncoding:
+		return json.Unmarshal(data, v)
+	case BinaryEncoding:
+		if u, ok := v.(encoding.BinaryUnmarshaler); ok {
+			return u.UnmarshalBinary(data)
+		}
+		return fmt.Errorf("%T does not support binary encoding", v)
+	}
+	return fmt.Errorf("Unknown encoding %s", enc)
+}
+
+// checkContentLength returns an error unless length is -1 ( unknown ) or positive
+func checkContentLength(length int64) error {
+	if length < -1 {
+		return fmt.Errorf("Invalid ContentLength %d", length)
+	}
+	return nil
+}
+
+// Binary encoding primitives, strings and headers are length prefixed using varints
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendHeader(b []byte, header http.Header) []byte {
+	b = binary.AppendUvarint(b, uint64(len(header)))
+	for name, values := range header {
+		b = appendString(b, name)
+		b = binary.AppendUvarint(b, uint64(len(values)))
+		for _, value := range values {
+			b = appendString(b, value)
+		}
+	}
+	return b
+}
+
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = ErrInvalidBinary
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = ErrInvalidBinary
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) string() string {
+	size := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if size > uint64(len(r.data)) {
+		r.err = ErrInvalidBinary
+		return ""
+	}
+	s := string(r.data[:size])
+	r.data = r.data[size:]
+	return s
+}
+
+func (r *binaryReader) header() http.Header {
+	header := make(http.Header)
+	count := r.uvarint()
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		name := r.string()
+		size := r.uvarint()
+		for j := uint64(0); j < size && r.err == nil; j++ {
+			header[name] = append(header[name], r.string())
+		}
+	}
+	return header
+}
+
+// end returns the decoding error if any or an error if there is unexpected trailing data
+func (r *binaryReader) end() error {
+	if r.err == nil && len(r.data) > 0 {
+		r.err = ErrInvalidBinary
+	}
+	return r.err
+}
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+var encodings = []string{JSONEncoding, BinaryEncoding}
+
+func newTestHTTPRequest() *HTTPRequest {
+	return &HTTPRequest{
+		Method: "POST",
+		URL:    "https://example.com/path/to/resource?query=value",
+		Header: map[string][]string{
+			"Accept":          {"application/json"},
+			"Accept-Encoding": {"gzip, deflate"},
+			"Content-Type":    {"application/json"},
+			"User-Agent":      {"wsp-test/1.0"},
+			"X-Forwarded-For": {"192.0.2.1", "198.51.100.1"},
+		},
+		ContentLength: 1024,
+	}
+}
+
+func newTestHTTPResponse() *HTTPResponse {
+	resp := NewHTTPResponse()
+	resp.StatusCode = 200
+	resp.Header = map[string][]string{
+		"Content-Type":  {"application/json"},
+		"Cache-Control": {"no-cache"},
+		"Set-Cookie":    {"a=1", "b=2"},
+	}
+	resp.ContentLength = 4096
+	return resp
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	for _, enc := range encodings {
+		request := newTestHTTPRequest()
+		data, err := Marshal(enc, request)
+		if err != nil {
+			t.Fatalf("%s : unable to marshal request : %s", enc, err)
+		}
+		decodedRequest := new(HTTPRequest)
+		if err := Unmarshal(enc, data, decodedRequest); err != nil {
+			t.Fatalf("%s : unable to unmarshal request : %s", enc, err)
+		}
+		if !reflect.DeepEqual(request, decodedRequest) {
+			t.Fatalf("%s : request %+v decoded as %+v", enc, request, decodedRequest)
+		}
+
+		response := newTestHTTPResponse()
+		data, err = Marshal(enc, response)
+		if err != nil {
+			t.Fatalf("%s : unable to marshal response : %s", enc, err)
+		}
+		decodedResponse := new(HTTPResponse)
+		if err := Unmarshal(enc, data, decodedResponse); err != nil {
+			t.Fatalf("%s : unable to unmarshal response : %s", enc, err)
+		}
+		if !reflect.DeepEqual(response, decodedResponse) {
+			t.Fatalf("%s : response %+v decoded as %+v", enc, response, decodedResponse)
+		}
+	}
+}
+
+func TestUnmarshalInvalidBinary(t *testing.T) {
+	data, err := Marshal(BinaryEncoding, newTestHTTPRequest())
+	if err != nil {
+		t.Fatalf("Unable to marshal request : %s", err)
+	}
+	if err := Unmarshal(BinaryEncoding, data[:len(data)/2], new(HTTPRequest)); err == nil {
+		t.Fatal("Unmarshal should fail on a truncated message")
+	}
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	for _, enc := range encodings {
+		b.Run(enc, func(b *testing.B) {
+			request := newTestHTTPRequest()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Marshal(enc, request); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	for _, enc := range encodings {
+		b.Run(enc, func(b *testing.B) {
+			data, err := Marshal(enc, newTestHTTPRequest())
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := Unmarshal(enc, data, new(HTTPRequest)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRoundTrip(b *testing.B) {
+	req, err := UnserializeHTTPRequest(newTestHTTPRequest())
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, enc := range encodings {
+		b.Run(enc, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				data, err := Marshal(enc, SerializeHTTPRequest(req))
+				if err != nil {
+					b.Fatal(err)
+				}
+				request := new(HTTPRequest)
+				if err := Unmarshal(enc, data, request); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := UnserializeHTTPRequest(request); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
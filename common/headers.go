@@ -0,0 +1,45 @@
+package common
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Hop-by-hop headers only apply to a single connection and must not be forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopHeaders returns a copy of the header without the hop-by-hop headers
+// and the headers listed in the Connection header.
+// "Te: trailers" is kept as gRPC backends require it.
+func RemoveHopHeaders(header http.Header) http.Header {
+	if header == nil {
+		return nil
+	}
+	header = header.Clone()
+
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		if name == "Te" && header.Get("Te") == "trailers" {
+			continue
+		}
+		header.Del(name)
+	}
+	return header
+}
@@ -0,0 +1,49 @@
+package common
+
+import "fmt"
+
+// Websocket subprotocols, negotiated in the websocket handshake so that
+// framing changes are only used when both sides support them
+const (
+	ProtocolV1 = "wsp.v1"
+	ProtocolV2 = "wsp.v2" // The Server acknowledges the greeting message with GreetingAck
+)
+
+// GreetingAck is sent by the Server once the greeting message is accepted ( wsp.v2 )
+// A rejected greeting is answered with a close message carrying the reason instead
+const GreetingAck = "ok"
+
+// Protocols are the supported subprotocols, the newest first
+var Protocols = []string{ProtocolV2, ProtocolV1}
+
+// NegotiatedProtocol returns the subprotocol of a websocket connection
+// Peers that don't negotiate a subprotocol speak wsp.v1
+func NegotiatedProtocol(subprotocol string) string {
+	if subprotocol == "" {
+		return ProtocolV1
+	}
+	return subprotocol
+}
+
+// ValidateProtocols returns an error if a subprotocol is not supported
+func ValidateProtocols(protocols []string) error {
+	if len(protocols) == 0 {
+		return fmt.Errorf("No protocol")
+	}
+	for _, protocol := range protocols {
+		if !HasProtocol(Protocols, protocol) {
+			return fmt.Errorf("Invalid protocol %s", protocol)
+		}
+	}
+	return nil
+}
+
+// HasProtocol returns true if the subprotocol is in the list
+func HasProtocol(protocols []string, protocol string) bool {
+	for _, p := range protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// redacted replaces the sensitive values in the logs
+var redacted = []byte("REDACTED")
+
+// Redactor is an io.Writer redacting sensitive values from the log lines before writing them
+type Redactor struct {
+	w        io.Writer
+	params   []*regexp.Regexp
+	patterns []*regexp.Regexp
+}
+
+// NewRedactor creates a Redactor writing to w, the values of the query parameters
+// named in params and the matches of the regular expressions in patterns are redacted
+func NewRedactor(w io.Writer, params []string, patterns []string) (redactor *Redactor, err error) {
+	redactor = &Redactor{w: w}
+	for _, param := range params {
+		redactor.params = append(redactor.params, regexp.MustCompile(`([?&;]`+regexp.QuoteMeta(param)+`=)[^&;#\s"]*`))
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redaction pattern %s : %s", pattern, err)
+		}
+		redactor.patterns = append(redactor.patterns, re)
+	}
+	return
+}
+
+// Write implements io.Writer, a log.Logger writes each log line with a single call
+func (redactor *Redactor) Write(p []byte) (n int, err error) {
+	line := p
+	for _, re := range redactor.params {
+		line = re.ReplaceAll(line, append([]byte("${1}"), redacted...))
+	}
+	for _, re := range redactor.patterns {
+		line = re.ReplaceAll(line, redacted)
+	}
+	_, err = redactor.w.Write(line)
+	return len(p), err
+}
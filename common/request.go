@@ -1,6 +1,7 @@
 package common
 
 import (
+	"encoding/binary"
 	"net/http"
 	"net/url"
 )
@@ -11,6 +12,7 @@ type HTTPRequest struct {
 	URL           string
 	Header        map[string][]string
 	ContentLength int64
+	NoBody        bool // No body message follows, only set if the Client supports it
 }
 
 // SerializeHTTPRequest create a new HTTPRequest from a http.Request
@@ -18,7 +20,7 @@ func SerializeHTTPRequest(req *http.Request) (r *HTTPRequest) {
 	r = new(HTTPRequest)
 	r.URL = req.URL.String()
 	r.Method = req.Method
-	r.Header = req.Header
+	r.Header = RemoveHopHeaders(req.Header)
 	r.ContentLength = req.ContentLength
 	return
 }
@@ -32,6 +34,40 @@ func UnserializeHTTPRequest(req *HTTPRequest) (r *http.Request, err error) {
 		return
 	}
 	r.Header = req.Header
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	err = checkContentLength(req.ContentLength)
+	if err != nil {
+		return
+	}
 	r.ContentLength = req.ContentLength
 	return
 }
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (req *HTTPRequest) MarshalBinary() ([]byte, error) {
+	var b []byte
+	b = appendString(b, req.Method)
+	b = appendString(b, req.URL)
+	b = appendHeader(b, req.Header)
+	b = binary.AppendVarint(b, req.ContentLength)
+	if req.NoBody {
+		// Only appended if set so that the message stays readable by older Clients
+		b = binary.AppendUvarint(b, 1)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (req *HTTPRequest) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{data: data}
+	req.Method = r.string()
+	req.URL = r.string()
+	req.Header = r.header()
+	req.ContentLength = r.varint()
+	if len(r.data) > 0 {
+		req.NoBody = r.uvarint() == 1
+	}
+	return r.end()
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"encoding/binary"
 	"net/http"
 )
 
@@ -15,7 +16,7 @@ type HTTPResponse struct {
 func SerializeHTTPResponse(resp *http.Response) *HTTPResponse {
 	r := new(HTTPResponse)
 	r.StatusCode = resp.StatusCode
-	r.Header = resp.Header
+	r.Header = RemoveHopHeaders(resp.Header)
 	r.ContentLength = resp.ContentLength
 	return r
 }
@@ -26,3 +27,39 @@ func NewHTTPResponse() (r *HTTPResponse) {
 	r.Header = make(http.Header)
 	return
 }
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (resp *HTTPResponse) MarshalBinary() ([]byte, error) {
+	var b []byte
+	b = binary.AppendVarint(b, int64(resp.StatusCode))
+	b = appendHeader(b, resp.Header)
+	b = binary.AppendVarint(b, resp.ContentLength)
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (resp *HTTPResponse) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{data: data}
+	resp.StatusCode = int(r.varint())
+	resp.Header = r.header()
+	resp.ContentLength = r.varint()
+	return r.end()
+}
+
+// HTTPTrailer holds the trailers of a http.Response
+// It is sent after the response body if the Client forwards trailers
+type HTTPTrailer struct {
+	Header http.Header
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (trailer *HTTPTrailer) MarshalBinary() ([]byte, error) {
+	return appendHeader(nil, trailer.Header), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (trailer *HTTPTrailer) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{data: data}
+	trailer.Header = r.header()
+	return r.end()
+}
@@ -0,0 +1,47 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// ClientSettings are sent by the Client to the Server in the greeting message
+type ClientSettings struct {
+	ID          string
+	Name        string
+	PoolSize    int
+	MaxBodySize int64
+	Checksum    bool
+	Encoding    string
+	Reverse     bool
+	Version     string
+	Trailers    bool
+	NoBody      bool // The Client supports requests without body message
+	Control     bool // The Client handles control requests ( ControlScheme )
+}
+
+// ParseGreeting parses the greeting message of a Client speaking the subprotocol
+// Clients speaking wsp.v1 may send the legacy "id_poolsize" greeting instead of the JSON settings
+func ParseGreeting(greeting []byte, protocol string) (settings *ClientSettings, err error) {
+	settings = new(ClientSettings)
+	if protocol == ProtocolV1 && !bytes.HasPrefix(bytes.TrimSpace(greeting), []byte("{")) {
+		i := bytes.LastIndexByte(greeting, '_')
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid legacy greeting message")
+		}
+		settings.ID = string(greeting[:i])
+		settings.PoolSize, err = strconv.Atoi(string(greeting[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid legacy greeting pool size : %s", err)
+		}
+		return
+	}
+
+	err = json.Unmarshal(greeting, settings)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
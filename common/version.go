@@ -0,0 +1,14 @@
+package common
+
+// Version and Commit of the build, they are set at build time with -ldflags
+// "-X github.com/root-gg/wsp/common.Version=1.0.0 -X github.com/root-gg/wsp/common.Commit=abcdef"
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+// BuildInfo is returned by the /version endpoint of the Server
+type BuildInfo struct {
+	Version string
+	Commit  string
+}
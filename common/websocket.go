@@ -0,0 +1,24 @@
+package common
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseTimeout is the time to wait for the remote peer close message
+const CloseTimeout = time.Second
+
+// CloseWebsocket performs the websocket close handshake before closing the underlying connection
+// It sends a normal closure close message and waits for the reader goroutine to receive the
+// remote peer close message ( signaled by closing readDone ) or for CloseTimeout to expire.
+func CloseWebsocket(ws *websocket.Conn, readDone <-chan struct{}) {
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(CloseTimeout))
+
+	select {
+	case <-readDone:
+	case <-time.After(CloseTimeout):
+	}
+
+	ws.Close()
+}
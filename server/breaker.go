@@ -0,0 +1,92 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// CircuitBreaker stops routing requests to a Pool after too many consecutive failures
+//
+// Once the threshold is reached the breaker opens and the pool is skipped by the
+// dispatcher for the cooldown duration. It then half-opens to let a single probe
+// request test the recovery : a success closes the breaker, a failure opens it again.
+// A probe which doesn't report back within the cooldown is replaced by another one.
+type CircuitBreaker struct {
+	id        string
+	threshold int
+	cooldown  time.Duration
+
+	failures   int
+	openUntil  time.Time
+	probeUntil time.Time // A probe request is in flight until then
+	lock       sync.Mutex
+
+	logger *log.Logger
+}
+
+// NewCircuitBreaker creates a new CircuitBreaker of the pool id, a zero threshold disables it
+func NewCircuitBreaker(id string, threshold int, cooldown time.Duration, logger *log.Logger) (cb *CircuitBreaker) {
+	cb = new(CircuitBreaker)
+	cb.id = id
+	cb.threshold = threshold
+	cb.cooldown = cooldown
+	cb.logger = logger
+	return
+}
+
+// Allow returns true if requests can be routed to the pool
+// Once half-open it returns true only once per cooldown until the probe reports back
+func (cb *CircuitBreaker) Allow() bool {
+	if cb.threshold <= 0 {
+		return true
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if cb.failures < cb.threshold {
+		return true
+	}
+
+	now := time.Now()
+	if now.Before(cb.openUntil) || now.Before(cb.probeUntil) {
+		return false
+	}
+	cb.logger.Printf("Circuit breaker of %s half-open, probing", cb.id)
+	cb.probeUntil = now.Add(cb.cooldown)
+	return true
+}
+
+// Success notifies that a request succeeded
+func (cb *CircuitBreaker) Success() {
+	if cb.threshold <= 0 {
+		return
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if cb.failures >= cb.threshold {
+		cb.logger.Printf("Circuit breaker of %s closed", cb.id)
+	}
+	cb.failures = 0
+	cb.probeUntil = time.Time{}
+}
+
+// Failure notifies that a request failed
+func (cb *CircuitBreaker) Failure() {
+	if cb.threshold <= 0 {
+		return
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.logger.Printf("Circuit breaker of %s opened for %s after %d failures", cb.id, cb.cooldown, cb.failures)
+		cb.openUntil = time.Now().Add(cb.cooldown)
+		cb.probeUntil = time.Time{}
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	output := new(bytes.Buffer)
+	cb := NewCircuitBreaker("client-1", 2, 50*time.Millisecond, log.New(output, "", 0))
+
+	cb.Failure()
+	if !cb.Allow() {
+		t.Fatal("Breaker opened before the threshold")
+	}
+	cb.Failure()
+	if cb.Allow() {
+		t.Fatal("Breaker not opened after the threshold")
+	}
+
+	// A single probe is allowed once the cooldown is over
+	time.Sleep(60 * time.Millisecond)
+	if !cb.Allow() {
+		t.Fatal("No probe allowed after the cooldown")
+	}
+	for i := 0; i < 10; i++ {
+		if cb.Allow() {
+			t.Fatal("More than one probe allowed while half-open")
+		}
+	}
+
+	// A failed probe opens the breaker again
+	cb.Failure()
+	if cb.Allow() {
+		t.Fatal("Breaker not opened again after a failed probe")
+	}
+
+	// A successful probe closes it
+	time.Sleep(60 * time.Millisecond)
+	if !cb.Allow() {
+		t.Fatal("No probe allowed after the cooldown")
+	}
+	cb.Success()
+	for i := 0; i < 10; i++ {
+		if !cb.Allow() {
+			t.Fatal("Breaker not closed after a successful probe")
+		}
+	}
+
+	for _, message := range []string{"Circuit breaker of client-1 opened", "Circuit breaker of client-1 closed"} {
+		if !strings.Contains(output.String(), message) {
+			t.Fatalf("Missing log %q in %q", message, output.String())
+		}
+	}
+}
+
+func TestCircuitBreakerLostProbe(t *testing.T) {
+	cb := NewCircuitBreaker("client-1", 1, 50*time.Millisecond, log.New(new(bytes.Buffer), "", 0))
+	cb.Failure()
+
+	time.Sleep(60 * time.Millisecond)
+	if !cb.Allow() {
+		t.Fatal("No probe allowed after the cooldown")
+	}
+
+	// The probe never reports back, another one is allowed after the cooldown
+	time.Sleep(60 * time.Millisecond)
+	if !cb.Allow() {
+		t.Fatal("No probe allowed after a lost probe")
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+// coalesceKeyHeaders are the request headers that always make requests different
+// as they change the response or the remote Proxy serving it
+var coalesceKeyHeaders = []string{"Range", "If-Range", "X-PROXY-CLIENT-ID", "X-PROXY-TIMEOUT", "X-PROXY-FAIL-FAST"}
+
+// coalescedCall is a backend round-trip shared by identical concurrent GET requests
+type coalescedCall struct {
+	done     chan struct{}
+	response *bufferedResponse // nil if the round-trip failed or the response is too large
+	tooLarge bool              // The response exceeds Config.CoalesceMaxSize
+}
+
+// coalesce executes identical concurrent GET requests only once
+// The first request is forwarded and its response is streamed to it and buffered for
+// every request received in the meantime with the same method, URL and headers.
+// Requests waiting for a response larger than Config.CoalesceMaxSize are forwarded.
+func (server *Server) coalesce(w http.ResponseWriter, r *http.Request) {
+	key := server.coalesceKey(r)
+
+	server.coalesceLock.Lock()
+	call, ok := server.coalesced[key]
+	if !ok {
+		call = &coalescedCall{done: make(chan struct{})}
+		server.coalesced[key] = call
+	}
+	server.coalesceLock.Unlock()
+
+	if ok {
+		// Wait for the first request to complete
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			return
+		}
+		if call.tooLarge {
+			server.forward(w, r)
+			return
+		}
+		if call.response == nil {
+			server.proxyErrorf(w, "Coalesced request failed")
+			return
+		}
+		call.response.writeTo(w)
+		return
+	}
+
+	tee := &teeResponse{ResponseWriter: w, buffer: newBufferedResponse(), max: server.Config.CoalesceMaxSize}
+	defer func() {
+		err := recover()
+		if err == nil && tee.buffer != nil {
+			call.response = tee.buffer
+		}
+		call.tooLarge = err == nil && tee.buffer == nil
+
+		server.coalesceLock.Lock()
+		delete(server.coalesced, key)
+		server.coalesceLock.Unlock()
+		close(call.done)
+
+		if err != nil {
+			panic(err)
+		}
+	}()
+	server.forward(tee, r)
+}
+
+// coalesceKey returns the key identifying identical requests
+func (server *Server) coalesceKey(r *http.Request) string {
+	key := []string{r.Method, r.URL.String()}
+	for _, header := range coalesceKeyHeaders {
+		key = append(key, strings.Join(r.Header.Values(header), ","))
+	}
+	for _, header := range server.Config.CoalesceHeaders {
+		key = append(key, strings.Join(r.Header.Values(header), ","))
+	}
+	return strings.Join(key, "\n")
+}
+
+// teeResponse is a http.ResponseWriter buffering a copy of the response
+// The copy is dropped once it exceeds max bytes
+type teeResponse struct {
+	http.ResponseWriter
+	buffer      *bufferedResponse // nil once the response exceeds max
+	max         int64
+	wroteHeader bool
+}
+
+func (tee *teeResponse) WriteHeader(status int) {
+	tee.wroteHeader = true
+	if tee.buffer != nil {
+		tee.buffer.status = status
+		for header, values := range tee.ResponseWriter.Header() {
+			tee.buffer.header[header] = append([]string(nil), values...)
+		}
+	}
+	tee.ResponseWriter.WriteHeader(status)
+}
+
+func (tee *teeResponse) Write(p []byte) (int, error) {
+	if !tee.wroteHeader {
+		tee.WriteHeader(http.StatusOK)
+	}
+	if tee.buffer != nil {
+		if int64(tee.buffer.body.Len()+len(p)) > tee.max {
+			tee.buffer = nil
+		} else {
+			tee.buffer.body.Write(p)
+		}
+	}
+	return tee.ResponseWriter.Write(p)
+}
+
+func (tee *teeResponse) Flush() {
+	if flusher, ok := tee.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// bufferedResponse is a http.ResponseWriter keeping the response in memory
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+func (response *bufferedResponse) Header() http.Header {
+	return response.header
+}
+
+func (response *bufferedResponse) WriteHeader(status int) {
+	response.status = status
+}
+
+func (response *bufferedResponse) Write(p []byte) (int, error) {
+	return response.body.Write(p)
+}
+
+// writeTo sends a copy of the buffered response
+func (response *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for header, values := range response.header {
+		w.Header()[header] = append([]string(nil), values...)
+	}
+	w.WriteHeader(response.status)
+	w.Write(response.body.Bytes())
+}
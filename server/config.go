@@ -1,6 +1,7 @@
 package server
 
 import (
+	"fmt"
 	"io/ioutil"
 
 	"gopkg.in/yaml.v2"
@@ -10,13 +11,70 @@ import (
 
 // Config configures an Server
 type Config struct {
-	Host        string
-	Port        int
-	Timeout     int
-	IdleTimeout int
-	Whitelist   []*common.Rule
-	Blacklist   []*common.Rule
-	SecretKey   string
+	Host                       string
+	Port                       int
+	Timeout                    common.Milliseconds
+	MaxTimeout                 common.Milliseconds
+	IdleTimeout                common.Milliseconds
+	IdleSelection              string
+	Whitelist                  []*common.Rule
+	Blacklist                  []*common.Rule
+	SecretKey                  string
+	AdminKey                   string
+	StatusKey                  string
+	RedactQueryParams          []string
+	RedactPatterns             []string
+	Pprof                      bool
+	CircuitBreakerThreshold    int
+	CircuitBreakerCooldown     int
+	PauseQueueSize             int
+	MaxRequestsPerConnection   int
+	MaxBusyTime                int
+	AcquisitionWaitThreshold   int
+	ShutdownTimeout            int
+	MultipartMaxParts          int
+	MultipartMaxPartSize       int64
+	SpoolThreshold             int64
+	SpoolDir                   string
+	SpoolMaxSize               int64
+	ReverseWhitelist           []*common.Rule
+	ReverseTimeout             common.Milliseconds
+	AllowedSchemes             []string
+	TrustedProxies             []string
+	TCPKeepAlive               int
+	H2C                        bool
+	MinConnections             int
+	WarmupTimeout              int
+	MinIdleConnections         int
+	Coalesce                   bool
+	CoalesceHeaders            []string
+	CoalesceMaxSize            int64
+	AllowedOrigins             []string
+	MaxConcurrentRegistrations int
+	MaxConcurrentRequests      int
+	RequestQueueSize           int
+	Upstream                   string
+	UpstreamTimeout            common.Milliseconds
+	ProbeTimeout               int
+	MaxMetadataSize            int64
+	MaxResponseHeaders         int
+	TrimResponseHeaders        bool
+	FailFast                   bool
+	MaxPoolConnections         int
+	WaitForPool                bool
+	LatencyPollInterval        int
+	StatsPushInterval          int
+	StatusCodes                map[string]int
+	EnableCompression          bool
+	CompressionMinSize         int64
+	CompressionSkipTypes       []string
+	Protocols                  []string
+	MaxHops                    int
+	MaxTenants                 int
+	MaxTakeRetries             int
+	MetricsEnabled             bool
+	TLSCertFile                string
+	TLSKeyFile                 string
 }
 
 // NewConfig creates a new ProxyConfig
@@ -25,9 +83,29 @@ func NewConfig() (config *Config) {
 	config.Host = "127.0.0.1"
 	config.Port = 8080
 	config.Timeout = 1000
+	config.MaxTimeout = 30000
+	config.UpstreamTimeout = 30000
+	config.ReverseTimeout = 30000
+	config.SpoolMaxSize = 4 << 30
+	config.AllowedSchemes = []string{"http", "https"}
 	config.IdleTimeout = 60000
+	config.IdleSelection = "lru"
+	config.CircuitBreakerCooldown = 30000
+	config.PauseQueueSize = 1000
+	config.AcquisitionWaitThreshold = 100
+	config.ShutdownTimeout = 30000
+	config.WarmupTimeout = 60000
+	config.MaxMetadataSize = 1048576
+	config.CompressionMinSize = 1024
+	config.CompressionSkipTypes = common.DefaultCompressionSkipTypes
+	config.Protocols = common.Protocols
+	config.MaxHops = 10
+	config.MaxTakeRetries = 10
+	config.CoalesceMaxSize = 1 << 20
+	config.CoalesceHeaders = []string{"Accept", "Accept-Encoding", "Authorization", "Cookie"}
 	config.Whitelist = make([]*common.Rule, 0)
 	config.Blacklist = make([]*common.Rule, 0)
+	config.ReverseWhitelist = make([]*common.Rule, 0)
 	return
 }
 
@@ -59,5 +137,40 @@ func LoadConfiguration(path string) (config *Config, err error) {
 		}
 	}
 
+	for _, rule := range config.ReverseWhitelist {
+		if err = rule.Compile(); err != nil {
+			return
+		}
+	}
+
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, fmt.Errorf("Both tlscertfile and tlskeyfile must be set to enable TLS")
+	}
+
+	if config.IdleSelection != "lru" && config.IdleSelection != "mru" {
+		return nil, fmt.Errorf("Invalid idleselection %s", config.IdleSelection)
+	}
+
+	if err = common.ValidateProtocols(config.Protocols); err != nil {
+		return nil, err
+	}
+
+	if _, err = common.NewRedactor(nil, config.RedactQueryParams, config.RedactPatterns); err != nil {
+		return nil, err
+	}
+
+	if _, err = parseNetworks(config.TrustedProxies); err != nil {
+		return nil, err
+	}
+
+	for failure, status := range config.StatusCodes {
+		if _, ok := defaultStatusCodes[failure]; !ok {
+			return nil, fmt.Errorf("Unknown statuscodes failure %s", failure)
+		}
+		if status < 100 || status > 999 {
+			return nil, fmt.Errorf("Invalid statuscodes %s status %d", failure, status)
+		}
+	}
+
 	return
 }
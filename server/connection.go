@@ -1,13 +1,14 @@
 package server
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -24,20 +25,45 @@ const (
 
 // Connection manage a single websocket connection from
 type Connection struct {
+	id           uint64
 	pool         *Pool
 	ws           *websocket.Conn
+	protocol     string
+	settings     *common.ClientSettings // Settings of the remote Proxy when the connection was registered
 	status       int
 	idleSince    time.Time
+	busySince    time.Time
+	requests     int
+	retire       bool
 	lock         sync.Mutex
 	nextResponse chan chan io.Reader
+	reading      int32
+	closed       chan struct{}
+	readDone     chan struct{}
+	pong         chan struct{}
 }
 
 // NewConnection return a new Connection
-func NewConnection(pool *Pool, ws *websocket.Conn) (connection *Connection) {
+func NewConnection(pool *Pool, ws *websocket.Conn, settings *common.ClientSettings) (connection *Connection) {
 	connection = new(Connection)
+	connection.id = atomic.AddUint64(&pool.server.connectionID, 1)
 	connection.pool = pool
 	connection.ws = ws
+	connection.protocol = common.NegotiatedProtocol(ws.Subprotocol())
+	connection.settings = settings
 	connection.nextResponse = make(chan chan io.Reader)
+	connection.closed = make(chan struct{})
+	connection.readDone = make(chan struct{})
+	connection.pong = make(chan struct{}, 1)
+
+	// Pongs are handled by the read() goroutine
+	ws.SetPongHandler(func(string) error {
+		select {
+		case connection.pong <- struct{}{}:
+		default:
+		}
+		return nil
+	})
 
 	connection.Release()
 
@@ -48,15 +74,17 @@ func NewConnection(pool *Pool, ws *websocket.Conn) (connection *Connection) {
 
 // read the incoming message of the connection
 func (connection *Connection) read() {
+	reason := common.CloseError
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Websocket crash recovered : %s", r)
+			connection.logf("Websocket crash recovered : %s", r)
 		}
-		connection.Close()
+		connection.Close(reason)
+		close(connection.readDone)
 	}()
 
 	for {
-		if connection.status == CLOSED {
+		if connection.getStatus() == CLOSED {
 			break
 		}
 
@@ -71,20 +99,31 @@ func (connection *Connection) read() {
 		// We will block here until a message is received or the ws is closed
 		_, reader, err := connection.ws.NextReader()
 		if err != nil {
+			if _, ok := err.(*websocket.CloseError); ok {
+				reason = common.ClosePeer
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					connection.logf("Connection closed by the remote Proxy : %s", err)
+				}
+			}
 			break
 		}
 
-		if connection.status != BUSY {
+		if connection.getStatus() != BUSY {
 			// We received a wild unexpected message
+			reason = common.CloseProtocol
 			break
 		}
 
 		// We received a message from the proxy
 		// It is expected to be either a HttpResponse or a HttpResponseBody
 		// We wait for proxyRequest to send a channel to get the message
-		c := <-connection.nextResponse
-		if c == nil {
+		var c chan io.Reader
+		select {
+		case c = <-connection.nextResponse:
+		case <-connection.closed:
 			// We have been unlocked by Close()
+		}
+		if c == nil {
 			break
 		}
 
@@ -94,107 +133,315 @@ func (connection *Connection) read() {
 		// Wait for proxyRequest to close the channel
 		// this notify that it is done with the reader
 		<-c
+
+		// Drain what proxyRequest left unread, a failure means that the message is
+		// truncated and the websocket state is unknown so the connection is closed
+		_, err = io.Copy(ioutil.Discard, reader)
+		if err != nil {
+			connection.logf("Unable to drain message : %s", err)
+			reason = common.CloseProtocol
+			break
+		}
 	}
 }
 
 // Proxy a HTTP request through the Proxy over the websocket connection
 func (connection *Connection) proxyRequest(w http.ResponseWriter, r *http.Request) (err error) {
-	log.Printf("proxy request to %s", connection.pool.id)
+	connection.logf("proxy request")
 
 	// Serialize HTTP request
-	jsonReq, err := json.Marshal(common.SerializeHTTPRequest(r))
+	httpRequest := common.SerializeHTTPRequest(r)
+	httpRequest.NoBody = connection.settings.NoBody && r.ContentLength == 0
+	serializedRequest, err := common.Marshal(connection.settings.Encoding, httpRequest)
 	if err != nil {
-		return fmt.Errorf("Unable to serialize request : %s", err)
+		return &RecoverableError{fmt.Errorf("Unable to serialize request : %s", err)}
 	}
 
 	// Send the serialized HTTP request to the remote Proxy
-	err = connection.ws.WriteMessage(websocket.TextMessage, jsonReq)
+	err = connection.ws.WriteMessage(common.MessageType(connection.settings.Encoding), serializedRequest)
 	if err != nil {
-		return fmt.Errorf("Unable to write request : %s", err)
+		return &UnsentRequestError{fmt.Errorf("Unable to write request : %s", err)}
 	}
 
-	// Pipe the HTTP request body to the remote Proxy
-	bodyWriter, err := connection.ws.NextWriter(websocket.BinaryMessage)
-	if err != nil {
-		return fmt.Errorf("Unable to get request body writer : %s", err)
-	}
-	_, err = io.Copy(bodyWriter, r.Body)
-	if err != nil {
-		return fmt.Errorf("Unable to pipe request body : %s", err)
-	}
-	err = bodyWriter.Close()
-	if err != nil {
-		return fmt.Errorf("Unable to pipe request body (close) : %s", err)
+	// Pipe the HTTP request body to the remote Proxy, requests without body
+	// have no body message if the remote Proxy supports it
+	if !httpRequest.NoBody {
+		err = connection.writeRequestBody(r)
+		if err != nil {
+			return
+		}
 	}
 
 	// Get the serialized HTTP Response from the remote Proxy
-	// To do so send a new channel to the read() goroutine
-	// to get the next message reader
-	responseChannel := make(chan (io.Reader))
-	connection.nextResponse <- responseChannel
-	responseReader, more := <-responseChannel
-	if responseReader == nil {
-		if more {
-			// If more is false the channel is already closed
-			close(responseChannel)
-		}
+	releaseResponse, responseReader, err := connection.nextReader()
+	if err != nil {
 		return fmt.Errorf("Unable to get http response reader : %s", err)
 	}
 
 	// Read the HTTP Response
-	jsonResponse, err := ioutil.ReadAll(responseReader)
+	serializedResponse, err := connection.readMetadata(responseReader)
 	if err != nil {
-		close(responseChannel)
+		releaseResponse()
 		return fmt.Errorf("Unable to read http response : %s", err)
 	}
 
 	// Notify the read() goroutine that we are done reading the response
-	close(responseChannel)
+	releaseResponse()
 
 	// Deserialize the HTTP Response
 	httpResponse := new(common.HTTPResponse)
-	err = json.Unmarshal(jsonResponse, httpResponse)
+	err = common.Unmarshal(connection.settings.Encoding, serializedResponse, httpResponse)
 	if err != nil {
 		return fmt.Errorf("Unable to unserialize http response : %s", err)
 	}
 
+	if httpResponse.StatusCode >= 500 {
+		atomic.AddInt64(&connection.pool.server.stats.BackendErrors, 1)
+	}
+
+	// Feed the circuit breaker, a 527 means that the remote Proxy was unable to execute the request
+	// Control requests are not executed against a backend and don't tell the pool health
+	if r.URL.Scheme != common.ControlScheme {
+		if httpResponse.StatusCode == 527 {
+			connection.pool.breaker.Failure()
+			connection.pool.server.Metrics.failure(FailureDial)
+			httpResponse.StatusCode = connection.pool.server.statusCode(FailureDial)
+		} else {
+			connection.pool.breaker.Success()
+		}
+	}
+
+	// Reject or trim responses with too many headers, the body of rejected responses is discarded
+	var responseBodyWriter io.Writer = w
+	rejected := false
+	if max := connection.pool.server.Config.MaxResponseHeaders; max > 0 && len(httpResponse.Header) > max {
+		if connection.pool.server.Config.TrimResponseHeaders {
+			connection.logf("Trimming response with %d headers", len(httpResponse.Header))
+			httpResponse.Header = trimHeaders(httpResponse.Header, max)
+		} else {
+			connection.logf("Rejecting response with %d headers", len(httpResponse.Header))
+			rejected = true
+			responseBodyWriter = ioutil.Discard
+			httpResponse.Header = make(http.Header)
+			httpResponse.ContentLength = -1
+			httpResponse.StatusCode = http.StatusBadGateway
+		}
+	}
+
+	// Let the embedder modify the response, control requests are internal
+	var wrapBody func(io.Reader) io.Reader
+	if transform := connection.pool.server.ResponseTransform; transform != nil && !rejected && r.URL.Scheme != common.ControlScheme {
+		if httpResponse.Header == nil {
+			httpResponse.Header = make(http.Header)
+		}
+		wrapBody = transform(r, httpResponse)
+		if wrapBody != nil {
+			httpResponse.ContentLength = -1
+			httpResponse.Header.Del("Content-Length")
+		}
+	}
+
 	// Write response headers back to the client
-	for header, values := range httpResponse.Header {
+	for header, values := range common.RemoveHopHeaders(httpResponse.Header) {
 		for _, value := range values {
 			w.Header().Add(header, value)
 		}
 	}
+	if httpResponse.ContentLength > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(httpResponse.ContentLength, 10))
+	}
 	w.WriteHeader(httpResponse.StatusCode)
+	if rejected {
+		w.Write([]byte("Too many response headers\n"))
+	}
 
-	// Get the HTTP Response body from the remote Proxy
-	// To do so send a new channel to the read() goroutine
-	// to get the next message reader
-	responseBodyChannel := make(chan (io.Reader))
-	connection.nextResponse <- responseBodyChannel
-	responseBodyReader, more := <-responseBodyChannel
-	if responseBodyReader == nil {
-		if more {
-			// If more is false the channel is already closed
-			close(responseChannel)
+	// Send the headers right away, otherwise the response could be sent with a Content-Length
+	// header once the body has been written and the trailers would be dropped
+	if connection.settings.Trailers {
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
 		}
-		return fmt.Errorf("Unable to get http response body reader : %s", err)
+	}
+
+	// Get the HTTP Response body from the remote Proxy
+	releaseResponseBody, responseBodyReader, err := connection.nextReader()
+	if err != nil {
+		return &TruncatedResponseError{fmt.Errorf("Unable to get http response body reader : %s", err)}
+	}
+
+	if connection.settings.Checksum {
+		responseBodyReader = common.NewChecksumReader(responseBodyReader)
+	}
+	if wrapBody != nil {
+		responseBodyReader = wrapBody(responseBodyReader)
 	}
 
 	// Pipe the HTTP response body right from the remote Proxy to the client
-	_, err = io.Copy(w, responseBodyReader)
+	_, err = io.Copy(responseBodyWriter, responseBodyReader)
 	if err != nil {
-		close(responseBodyChannel)
-		return fmt.Errorf("Unable to pipe response body : %s", err)
+		releaseResponseBody()
+		return &TruncatedResponseError{err}
 	}
 
 	// Notify read() that we are done reading the response body
-	close(responseBodyChannel)
+	releaseResponseBody()
+
+	// Get the HTTP Response trailers from the remote Proxy
+	if connection.settings.Trailers {
+		releaseTrailer, trailerReader, err := connection.nextReader()
+		if err != nil {
+			return &TruncatedResponseError{fmt.Errorf("Unable to get http response trailer reader : %s", err)}
+		}
+		serializedTrailer, err := connection.readMetadata(trailerReader)
+		releaseTrailer()
+		if err != nil {
+			return &TruncatedResponseError{err}
+		}
+
+		trailer := new(common.HTTPTrailer)
+		err = common.Unmarshal(connection.settings.Encoding, serializedTrailer, trailer)
+		if err != nil {
+			return &TruncatedResponseError{err}
+		}
+		if !rejected {
+			for header, values := range trailer.Header {
+				for _, value := range values {
+					w.Header().Add(http.TrailerPrefix+header, value)
+				}
+			}
+		}
+	}
 
 	connection.Release()
 
 	return
 }
 
+// writeRequestBody sends the request body message, small or already compressed bodies are not compressed
+func (connection *Connection) writeRequestBody(r *http.Request) (err error) {
+	config := connection.pool.server.Config
+	connection.ws.EnableWriteCompression(common.Compressible(r.Header.Get("Content-Type"), r.ContentLength, config.CompressionMinSize, config.CompressionSkipTypes))
+	bodyWriter, err := connection.ws.NextWriter(websocket.BinaryMessage)
+	connection.ws.EnableWriteCompression(true)
+	if err != nil {
+		return fmt.Errorf("Unable to get request body writer : %s", err)
+	}
+	if connection.settings.Checksum {
+		bodyWriter = common.NewChecksumWriter(bodyWriter)
+	}
+	_, err = io.Copy(bodyWriter, r.Body)
+	if _, ok := err.(*InvalidBodyError); ok {
+		return
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to pipe request body : %s", err)
+	}
+	err = bodyWriter.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to pipe request body (close) : %s", err)
+	}
+	return
+}
+
+// probe sends a ping and waits for the pong to check that the remote Proxy is still alive
+func (connection *Connection) probe(timeout time.Duration) bool {
+	// Discard a late pong of a previous probe
+	select {
+	case <-connection.pong:
+	default:
+	}
+
+	err := connection.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout))
+	if err != nil {
+		return false
+	}
+
+	select {
+	case <-connection.pong:
+		return true
+	case <-connection.closed:
+		return false
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// readMetadata reads a response or trailer message of at most Config.MaxMetadataSize bytes
+func (connection *Connection) readMetadata(reader io.Reader) (data []byte, err error) {
+	max := connection.pool.server.Config.MaxMetadataSize
+	if max <= 0 {
+		return ioutil.ReadAll(reader)
+	}
+
+	data, err = ioutil.ReadAll(io.LimitReader(reader, max+1))
+	if err == nil && int64(len(data)) > max {
+		err = fmt.Errorf("Message exceeds %d bytes", max)
+	}
+	return
+}
+
+// errAlreadyReading is returned by nextReader while the previous message reader has not been released
+var errAlreadyReading = errors.New("already reading")
+
+// nextReader sends a new channel to the read() goroutine to get the next message reader
+// The release function must be called once done with the reader, until then the read()
+// goroutine doesn't read the websocket and any other nextReader call fails with errAlreadyReading
+// so that a message is never consumed by two readers
+func (connection *Connection) nextReader() (release func(), reader io.Reader, err error) {
+	if !atomic.CompareAndSwapInt32(&connection.reading, 0, 1) {
+		return nil, nil, errAlreadyReading
+	}
+
+	c := make(chan io.Reader)
+	select {
+	case connection.nextResponse <- c:
+		reader = <-c
+	case <-connection.closed:
+		atomic.StoreInt32(&connection.reading, 0)
+		return nil, nil, errors.New("connection closed")
+	}
+
+	released := false
+	release = func() {
+		if !released {
+			released = true
+			close(c)
+			atomic.StoreInt32(&connection.reading, 0)
+		}
+	}
+	return
+}
+
+// RecoverableError is returned by proxyRequest when the request failed before
+// anything was sent over the websocket, the connection can safely be used again
+type RecoverableError struct {
+	err error
+}
+
+func (e *RecoverableError) Error() string {
+	return e.err.Error()
+}
+
+// UnsentRequestError is returned by proxyRequest when the request could not be
+// sent to the remote Proxy, which therefore didn't execute it
+type UnsentRequestError struct {
+	err error
+}
+
+func (e *UnsentRequestError) Error() string {
+	return e.err.Error()
+}
+
+// TruncatedResponseError is returned by proxyRequest when the response
+// body could not be fully piped after the response headers have been sent
+type TruncatedResponseError struct {
+	err error
+}
+
+func (e *TruncatedResponseError) Error() string {
+	return fmt.Sprintf("Response body truncated : %s", e.err)
+}
+
 // Take notifies that this connection is going to be used
 func (connection *Connection) Take() bool {
 	connection.lock.Lock()
@@ -209,6 +456,8 @@ func (connection *Connection) Take() bool {
 	}
 
 	connection.status = BUSY
+	connection.busySince = time.Now()
+	connection.requests++
 	return true
 }
 
@@ -221,34 +470,73 @@ func (connection *Connection) Release() {
 		return
 	}
 
+	if connection.retire {
+		connection.close(common.CloseRetired)
+		return
+	}
+
+	// Recycle the connection once it has served enough requests
+	max := connection.pool.server.Config.MaxRequestsPerConnection
+	if max > 0 && connection.requests >= max {
+		connection.logf("Recycling connection after %d requests", connection.requests)
+		connection.close(common.CloseRecycled)
+		return
+	}
+
 	connection.idleSince = time.Now()
 	connection.status = IDLE
 
-	go connection.pool.Offer(connection)
+	connection.pool.Offer(connection)
+}
+
+// getStatus returns the status of the connection
+func (connection *Connection) getStatus() int {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	return connection.status
+}
+
+// ID returns the unique id of the connection
+func (connection *Connection) ID() uint64 {
+	return connection.id
+}
+
+// Retire closes the connection right away if it is idle
+// or once its current request is done otherwise
+func (connection *Connection) Retire() {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	if connection.status == IDLE {
+		connection.close(common.CloseRetired)
+		return
+	}
+	connection.retire = true
 }
 
 // Close the connection
-func (connection *Connection) Close() {
+func (connection *Connection) Close(reason common.CloseReason) {
 	connection.lock.Lock()
 	defer connection.lock.Unlock()
 
-	connection.close()
+	connection.close(reason)
 }
 
 // Close the connection ( without lock )
-func (connection *Connection) close() {
+func (connection *Connection) close(reason common.CloseReason) {
 	if connection.status == CLOSED {
 		return
 	}
 
-	log.Printf("Closing connection from %s", connection.pool.id)
+	connection.logf("Closing connection : %s", reason)
 
 	// This one will be executed *before* lock.Unlock()
 	defer func() { connection.status = CLOSED }()
 
 	// Unlock a possible read() wild message
-	close(connection.nextResponse)
+	close(connection.closed)
 
-	// Close the underlying TCP connection
-	connection.ws.Close()
+	// Close the websocket gracefully then the underlying TCP connection
+	go common.CloseWebsocket(connection.ws, connection.readDone)
 }
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp/common"
+)
+
+// testResponseBody is the body of the responses sent by respondPeer
+var testResponseBody = bytes.Repeat([]byte("x"), 1024)
+
+// respondPeer answers every request with testResponseBody like a remote Proxy using the default settings
+func respondPeer(ws *websocket.Conn) {
+	response := common.NewHTTPResponse()
+	response.StatusCode = http.StatusOK
+	response.ContentLength = int64(len(testResponseBody))
+	serializedResponse, _ := common.Marshal(common.JSONEncoding, response)
+
+	for {
+		// Request then request body
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+
+		if err := ws.WriteMessage(websocket.TextMessage, serializedResponse); err != nil {
+			return
+		}
+		if err := ws.WriteMessage(websocket.BinaryMessage, testResponseBody); err != nil {
+			return
+		}
+	}
+}
+
+// newTestPool returns a pool of a server which is not started, it is shut down at the end of the test
+func newTestPool(t testing.TB, config *Config) *Pool {
+	server := NewServer(config)
+	server.SetLogOutput(ioutil.Discard)
+	pool := NewPool(server, "test")
+	t.Cleanup(pool.Shutdown)
+	return pool
+}
+
+// registerTestConnection registers a connection of the pool, peer is run on the remote side
+func registerTestConnection(t testing.TB, pool *Pool, peer func(*websocket.Conn)) {
+	t.Helper()
+
+	ws, err := newTestWebsockets(t).connect(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.reserve(); err != nil {
+		t.Fatalf("Unable to reserve connection : %s", err)
+	}
+	if err := pool.Register(ws, pool.Settings()); err != nil {
+		t.Fatalf("Unable to register connection : %s", err)
+	}
+}
+
+func TestProxyRequest(t *testing.T) {
+	pool := newTestPool(t, NewConfig())
+	registerTestConnection(t, pool, respondPeer)
+
+	for i := 0; i < 3; i++ {
+		connection := pool.takeIdle()
+		if connection == nil {
+			t.Fatal("No idle connection")
+		}
+
+		req := httptest.NewRequest("GET", "http://backend/", nil)
+		recorder := httptest.NewRecorder()
+		if err := connection.proxyRequest(recorder, req); err != nil {
+			t.Fatalf("Unable to proxy request : %s", err)
+		}
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d", recorder.Code)
+		}
+		if !bytes.Equal(recorder.Body.Bytes(), testResponseBody) {
+			t.Fatalf("Unexpected body of %d bytes", recorder.Body.Len())
+		}
+	}
+}
+
+// newTestConnection registers a connection of the pool and takes it, peer is run on the remote side
+func newTestConnection(t testing.TB, pool *Pool, peer func(*websocket.Conn)) *Connection {
+	t.Helper()
+
+	registerTestConnection(t, pool, peer)
+	connection := pool.takeIdle()
+	if connection == nil {
+		t.Fatal("No idle connection")
+	}
+	return connection
+}
+
+func TestNextReaderAlreadyReading(t *testing.T) {
+	send := make(chan struct{})
+	connection := newTestConnection(t, newTestPool(t, NewConfig()), func(ws *websocket.Conn) {
+		<-send
+		ws.WriteMessage(websocket.BinaryMessage, []byte("first"))
+		ws.WriteMessage(websocket.BinaryMessage, []byte("second"))
+		discardPeer(ws)
+	})
+	close(send)
+
+	release, reader, err := connection.nextReader()
+	if err != nil {
+		t.Fatalf("Unable to get message reader : %s", err)
+	}
+
+	// Every concurrent call fails while the reader is not released
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := connection.nextReader(); err != errAlreadyReading {
+				t.Errorf("Expected %q, got %v", errAlreadyReading, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	message, _ := ioutil.ReadAll(reader)
+	release()
+	if string(message) != "first" {
+		t.Fatalf("Unexpected first message %q", message)
+	}
+
+	// The next message is read once the reader is released, exactly once
+	release, reader, err = connection.nextReader()
+	if err != nil {
+		t.Fatalf("Unable to get message reader : %s", err)
+	}
+	message, _ = ioutil.ReadAll(reader)
+	release()
+	if string(message) != "second" {
+		t.Fatalf("Unexpected second message %q", message)
+	}
+}
+
+func TestTruncatedMessageClosesConnection(t *testing.T) {
+	pool := newTestPool(t, NewConfig())
+	var drainFailed int32
+	pool.server.SetLogOutput(writerFunc(func(p []byte) (int, error) {
+		if bytes.Contains(p, []byte("Unable to drain message")) {
+			atomic.StoreInt32(&drainFailed, 1)
+		}
+		return len(p), nil
+	}))
+
+	send := make(chan struct{})
+	connection := newTestConnection(t, pool, func(ws *websocket.Conn) {
+		<-send
+		// A masked binary frame announcing 100 bytes, only 10 are sent before the connection is lost
+		frame := append([]byte{0x82, 0x80 | 100, 0, 0, 0, 0}, bytes.Repeat([]byte("x"), 10)...)
+		ws.UnderlyingConn().Write(frame)
+		ws.UnderlyingConn().Close()
+	})
+	close(send)
+
+	release, _, err := connection.nextReader()
+	if err != nil {
+		t.Fatalf("Unable to get message reader : %s", err)
+	}
+	// Leave the message unread for read() to drain it
+	release()
+
+	select {
+	case <-connection.readDone:
+	case <-time.After(time.Second):
+		t.Fatal("Connection not closed after a truncated message")
+	}
+	if status := connection.getStatus(); status != CLOSED {
+		t.Fatalf("Unexpected connection status %d", status)
+	}
+	if atomic.LoadInt32(&drainFailed) == 0 {
+		t.Fatal("The connection was not closed by the failed drain")
+	}
+}
+
+func BenchmarkProxyRequest(b *testing.B) {
+	pool := newTestPool(b, NewConfig())
+	registerTestConnection(b, pool, respondPeer)
+	req := httptest.NewRequest("GET", "http://backend/", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		connection := pool.takeIdle()
+		if connection == nil {
+			b.Fatal("No idle connection")
+		}
+		if err := connection.proxyRequest(httptest.NewRecorder(), req); err != nil {
+			b.Fatalf("Unable to proxy request : %s", err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"math/rand"
+	"reflect"
+)
+
+// Dispatcher chooses the connection used to serve a request
+// A custom Dispatcher can be set on the Server before calling Start
+type Dispatcher interface {
+	// Dispatch returns an idle connection received from one of the pools or nil if none is available
+	// The pools are all able to handle the request, Dispatch should block until a connection
+	// is available or the request timeout expires.
+	Dispatch(pools []*Pool, request *ConnectionRequest) *Connection
+}
+
+// SelectDispatcher is the default Dispatcher, it returns the first connection offered by any pool
+type SelectDispatcher struct{}
+
+// Dispatch implements Dispatcher
+func (dispatcher *SelectDispatcher) Dispatch(pools []*Pool, request *ConnectionRequest) *Connection {
+	// Build a select statement dynamically
+	cases := make([]reflect.SelectCase, len(pools)+1)
+
+	// Add all pools idle connection channel
+	for i, pool := range pools {
+		cases[i] = reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(pool.idle)}
+	}
+
+	// Add timeout channel
+	if request.timeout != nil {
+		cases[len(cases)-1] = reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(request.timeout)}
+	} else {
+		cases[len(cases)-1] = reflect.SelectCase{
+			Dir: reflect.SelectDefault}
+	}
+
+	for {
+		// This call blocks
+		chosen, value, ok := reflect.Select(cases)
+
+		if chosen == len(cases)-1 {
+			// a timeout occured
+			return nil
+		}
+		if !ok {
+			// a proxy pool has been removed, stop selecting its channel
+			cases[chosen].Chan = reflect.Value{}
+			continue
+		}
+		connection, _ := value.Interface().(*Connection)
+		return connection
+	}
+}
+
+// RandomDispatcher picks a random pool among those having an idle connection,
+// pools are weighted by the number of idle connections their remote Proxy keeps.
+// The selection is reproducible for a given rand.Source.
+type RandomDispatcher struct {
+	rand *rand.Rand
+}
+
+// NewRandomDispatcher creates a RandomDispatcher using the source
+func NewRandomDispatcher(source rand.Source) *RandomDispatcher {
+	return &RandomDispatcher{rand: rand.New(source)}
+}
+
+// Dispatch implements Dispatcher
+// It must not be called concurrently, the Server calls it from a single goroutine
+func (dispatcher *RandomDispatcher) Dispatch(pools []*Pool, request *ConnectionRequest) *Connection {
+	return weightedDispatch(dispatcher.rand, pools, request, poolWeight)
+}
+
+// weightedDispatch picks a random pool among those having an idle connection according to their weight
+func weightedDispatch(r *rand.Rand, pools []*Pool, request *ConnectionRequest, weight func(*Pool) int) *Connection {
+	candidates := make([]*Pool, len(pools))
+	copy(candidates, pools)
+
+	for len(candidates) > 0 {
+		// Pick a random pool
+		total := 0
+		for _, pool := range candidates {
+			total += weight(pool)
+		}
+		i := 0
+		if total > 0 {
+			n := r.Intn(total)
+			for ; i < len(candidates)-1; i++ {
+				n -= weight(candidates[i])
+				if n < 0 {
+					break
+				}
+			}
+		} else {
+			// No pool has a positive weight, pick one uniformly
+			i = r.Intn(len(candidates))
+		}
+
+		// Take its idle connection if there is one
+		select {
+		case connection, ok := <-candidates[i].idle:
+			if ok {
+				return connection
+			}
+		default:
+		}
+		candidates = append(candidates[:i], candidates[i+1:]...)
+	}
+
+	// No idle connection, wait for the first one to be available
+	return new(SelectDispatcher).Dispatch(pools, request)
+}
+
+func poolWeight(pool *Pool) int {
+	if size := pool.Settings().PoolSize; size > 0 {
+		return size
+	}
+	return 1
+}
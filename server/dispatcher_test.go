@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/root-gg/wsp/common"
+)
+
+// newTestPools returns pools which idle channel can hold one connection
+func newTestPools(n int) []*Pool {
+	pools := make([]*Pool, n)
+	for i := range pools {
+		pools[i] = &Pool{id: strconv.Itoa(i), latency: -1, idle: make(chan *Connection, 1)}
+		pools[i].settings.Store(&common.ClientSettings{ID: pools[i].id, PoolSize: 1})
+	}
+	return pools
+}
+
+// dispatchSequence returns the pools chosen by successive dispatches, every pool always has an idle connection
+func dispatchSequence(dispatcher Dispatcher, pools []*Pool, n int) []string {
+	connections := make(map[*Connection]*Pool)
+	for _, pool := range pools {
+		connection := new(Connection)
+		connections[connection] = pool
+		pool.idle <- connection
+	}
+
+	sequence := make([]string, n)
+	request := NewConnectionRequest(0, 0)
+	for i := range sequence {
+		connection := dispatcher.Dispatch(pools, request)
+		pool := connections[connection]
+		sequence[i] = pool.id
+		pool.idle <- connection
+	}
+	return sequence
+}
+
+func TestRandomDispatcherSeed(t *testing.T) {
+	// The first pool keeps 10 times more idle connections than the others
+	newWeightedPools := func() []*Pool {
+		pools := newTestPools(5)
+		pools[0].settings.Store(&common.ClientSettings{ID: pools[0].id, PoolSize: 10})
+		return pools
+	}
+
+	first := dispatchSequence(NewRandomDispatcher(rand.NewSource(42)), newWeightedPools(), 100)
+	second := dispatchSequence(NewRandomDispatcher(rand.NewSource(42)), newWeightedPools(), 100)
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("Same seed gave different selections :\n%v\n%v", first, second)
+	}
+
+	other := dispatchSequence(NewRandomDispatcher(rand.NewSource(43)), newWeightedPools(), 100)
+	if reflect.DeepEqual(first, other) {
+		t.Fatal("Different seeds gave the same selection")
+	}
+
+	selected := 0
+	for _, id := range first {
+		if id == "0" {
+			selected++
+		}
+	}
+	if selected < 50 {
+		t.Fatalf("The heaviest pool was selected only %d times out of %d", selected, len(first))
+	}
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	dispatchers := map[string]func() Dispatcher{
+		"select":  func() Dispatcher { return new(SelectDispatcher) },
+		"random":  func() Dispatcher { return NewRandomDispatcher(rand.NewSource(1)) },
+		"latency": func() Dispatcher { return NewLatencyDispatcher(rand.NewSource(1)) },
+	}
+	for _, name := range []string{"select", "random", "latency"} {
+		for _, n := range []int{1, 10, 100} {
+			b.Run(fmt.Sprintf("%s/%d", name, n), func(b *testing.B) {
+				dispatcher := dispatchers[name]()
+				pools := newTestPools(n)
+				request := NewConnectionRequest(0, 0)
+				connection := new(Connection)
+
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					pools[i%n].idle <- connection
+					if dispatcher.Dispatch(pools, request) != connection {
+						b.Fatal("No connection dispatched")
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestLatencyDispatcherHighLatency(t *testing.T) {
+	pools := newTestPools(3)
+	for _, pool := range pools {
+		pool.latency = 5000000
+	}
+
+	sequence := dispatchSequence(NewLatencyDispatcher(rand.NewSource(1)), pools, 10)
+	for _, id := range sequence {
+		if id == "" {
+			t.Fatalf("No pool selected : %v", sequence)
+		}
+	}
+}
+
+func TestWeightedDispatchZeroWeight(t *testing.T) {
+	pools := newTestPools(3)
+	for _, pool := range pools {
+		pool.idle <- new(Connection)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	zero := func(*Pool) int { return 0 }
+	for range pools {
+		if connection := weightedDispatch(r, pools, NewConnectionRequest(0, 0), zero); connection == nil {
+			t.Fatal("No connection dispatched when every pool weights zero")
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/nu7hatch/gouuid"
+)
+
+// RequestEvent describes a request handled by the Server
+type RequestEvent struct {
+	ID          string
+	Method      string
+	Destination string
+	Status      int // 0 if the response has been aborted before the headers were sent
+	Duration    time.Duration
+	PoolID      string // Remote Proxy that served the request, empty if none
+}
+
+type eventKey struct{}
+
+// startEvent wraps the response writer to record the response status of the request event
+// The event is emitted on Server.Events once the returned function is called
+func (server *Server) startEvent(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	if server.Events == nil {
+		return w, r, func() {}
+	}
+
+	event := &RequestEvent{Method: r.Method, Destination: r.Header.Get("X-PROXY-DESTINATION")}
+	if id, err := uuid.NewV4(); err == nil {
+		event.ID = id.String()
+	}
+
+	start := time.Now()
+	ew := &eventWriter{ResponseWriter: w, event: event}
+	r = r.WithContext(context.WithValue(r.Context(), eventKey{}, event))
+
+	return ew, r, func() {
+		event.Duration = time.Since(start)
+
+		// Never block a request on a slow consumer
+		select {
+		case server.Events <- event:
+		default:
+		}
+	}
+}
+
+// setEventPool records the remote Proxy serving the request
+func setEventPool(r *http.Request, pool *Pool) {
+	if event, ok := r.Context().Value(eventKey{}).(*RequestEvent); ok {
+		event.PoolID = pool.id
+	}
+}
+
+// eventWriter records the response status code
+type eventWriter struct {
+	http.ResponseWriter
+	event *RequestEvent
+}
+
+func (ew *eventWriter) WriteHeader(status int) {
+	if ew.event.Status == 0 {
+		ew.event.Status = status
+	}
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+func (ew *eventWriter) Write(p []byte) (int, error) {
+	if ew.event.Status == 0 {
+		ew.event.Status = http.StatusOK
+	}
+	return ew.ResponseWriter.Write(p)
+}
+
+func (ew *eventWriter) Flush() {
+	if flusher, ok := ew.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+)
+
+// Failure categories of the tunnel, Config.StatusCodes maps them to
+// the HTTP status code returned to the caller
+const (
+	// FailureNoPool : no remote Proxy is connected
+	FailureNoPool = "nopool"
+	// FailureTimeout : no proxy connection was available in time
+	FailureTimeout = "timeout"
+	// FailureDial : the remote Proxy was unable to execute the request
+	FailureDial = "dial"
+	// FailureProtocol : the request or response could not be transferred through the websocket
+	FailureProtocol = "protocol"
+)
+
+var defaultStatusCodes = map[string]int{
+	FailureNoPool:   526,
+	FailureTimeout:  526,
+	FailureDial:     527,
+	FailureProtocol: 526,
+}
+
+// statusCode returns the HTTP status code of a failure category
+func (server *Server) statusCode(failure string) int {
+	if status, ok := server.Config.StatusCodes[failure]; ok {
+		return status
+	}
+	return defaultStatusCodes[failure]
+}
+
+// failure logs the error and returns it to the caller with the status code of the failure category
+func (server *Server) failure(w http.ResponseWriter, failure string, err error) {
+	server.Metrics.failure(failure)
+	server.proxyErrorStatus(w, server.statusCode(failure), err)
+}
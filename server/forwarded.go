@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseNetworks parses a list of IP addresses and CIDR networks
+func parseNetworks(addresses []string) (networks []*net.IPNet, err error) {
+	for _, address := range addresses {
+		if !strings.Contains(address, "/") {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address %s", address)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			address = fmt.Sprintf("%s/%d", address, bits)
+		}
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network %s : %s", address, err)
+		}
+		networks = append(networks, network)
+	}
+	return
+}
+
+// isTrustedProxy returns true if the address belongs to Config.TrustedProxies
+func (server *Server) isTrustedProxy(address string) bool {
+	ip := net.ParseIP(strings.TrimSpace(address))
+	if ip == nil {
+		return false
+	}
+	for _, network := range server.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwardedFor sets the X-Forwarded-For and X-Real-IP headers forwarded to the backend
+// The X-Forwarded-For header of the caller is only kept if it is a trusted proxy, X-Real-IP
+// is then the last address of the chain that isn't a trusted proxy
+func (server *Server) setForwardedFor(r *http.Request) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Del("X-Real-IP")
+		return
+	}
+
+	var chain []string
+	if server.isTrustedProxy(ip) {
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, address := range strings.Split(header, ",") {
+				if address = strings.TrimSpace(address); address != "" {
+					chain = append(chain, address)
+				}
+			}
+		}
+	}
+	chain = append(chain, ip)
+
+	realIP := chain[0]
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !server.isTrustedProxy(chain[i]) {
+			realIP = chain[i]
+			break
+		}
+	}
+
+	r.Header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+	r.Header.Set("X-Real-IP", realIP)
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+)
+
+// trimHeaders returns the first max headers in alphabetical order
+func trimHeaders(header http.Header, max int) http.Header {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	trimmed := make(http.Header, max)
+	for _, name := range names[:max] {
+		trimmed[name] = header[name]
+	}
+	return trimmed
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// keepAlive returns the SO_KEEPALIVE and TCP_KEEPIDLE socket options of the connection
+func keepAlive(t testing.TB, conn net.Conn) (enabled int, idle int) {
+	t.Helper()
+
+	rawConn, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("Unable to get raw connection : %s", err)
+	}
+	var errEnabled, errIdle error
+	err = rawConn.Control(func(fd uintptr) {
+		enabled, errEnabled = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		idle, errIdle = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	})
+	for _, err := range []error{err, errEnabled, errIdle} {
+		if err != nil {
+			t.Fatalf("Unable to get socket options : %s", err)
+		}
+	}
+	return
+}
+
+func TestTCPKeepAlive(t *testing.T) {
+	config := NewConfig()
+	config.TCPKeepAlive = 7000
+	server := newTestServer(t, config)
+	newTestClient(t, server, newTestClientConfig())
+
+	server.lock.RLock()
+	var connection *Connection
+	for _, pool := range server.pools {
+		pool.lock.RLock()
+		connection = pool.connections[0]
+		pool.lock.RUnlock()
+	}
+	server.lock.RUnlock()
+
+	enabled, idle := keepAlive(t, connection.ws.UnderlyingConn())
+	if enabled == 0 {
+		t.Fatal("TCP keepalive is not enabled on accepted connections")
+	}
+	if idle != 7 {
+		t.Fatalf("Unexpected TCP keepalive idle time %ds", idle)
+	}
+}
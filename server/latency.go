@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/root-gg/wsp/common"
+)
+
+// pollLatency asks every Config.LatencyPollInterval each remote Proxy for its backend latency
+func (server *Server) pollLatency() {
+	interval := time.Duration(server.Config.LatencyPollInterval) * time.Millisecond
+	for {
+		select {
+		case <-server.done:
+			return
+		case <-time.After(interval):
+		}
+
+		server.lock.RLock()
+		pools := make([]*Pool, len(server.pools))
+		copy(pools, server.pools)
+		server.lock.RUnlock()
+
+		for _, pool := range pools {
+			// Only probe remote Proxies handling control requests
+			if !pool.Settings().Control {
+				continue
+			}
+			err := server.getLatency(pool)
+			if err != nil {
+				server.logger.Printf("Unable to get backend latency of %s : %s", pool.id, err)
+			}
+		}
+	}
+}
+
+// getLatency sends a latency control request to the remote Proxy and records the median latency of the pool
+func (server *Server) getLatency(pool *Pool) (err error) {
+	req, err := http.NewRequest("GET", common.ControlScheme+"://control/latency", http.NoBody)
+	if err != nil {
+		return
+	}
+
+	// Probe the pool only if a connection is idle rather than waiting in the dispatcher
+	connection := pool.takeIdle()
+	if connection == nil {
+		return
+	}
+
+	response := newBufferedResponse()
+	err = connection.proxyRequest(response, req)
+	if err != nil {
+		connection.Close(common.CloseError)
+		return
+	}
+	if response.status != http.StatusOK {
+		return fmt.Errorf("Unexpected status %d", response.status)
+	}
+
+	report := new(common.LatencyReport)
+	err = json.Unmarshal(response.body.Bytes(), report)
+	if err != nil {
+		return
+	}
+	// The remote Proxy didn't serve any request yet
+	if report.Samples > 0 {
+		atomic.StoreInt64(&pool.latency, report.P50)
+	}
+	return
+}
+
+// LatencyDispatcher picks a random pool among those having an idle connection,
+// pools are weighted by the inverse of the median backend latency reported by their
+// remote Proxy so that faster remote Proxies serve more requests. Pools without
+// latency report are weighted as the average of the others.
+type LatencyDispatcher struct {
+	rand *rand.Rand
+}
+
+// NewLatencyDispatcher creates a LatencyDispatcher using the source
+func NewLatencyDispatcher(source rand.Source) *LatencyDispatcher {
+	return &LatencyDispatcher{rand: rand.New(source)}
+}
+
+// Dispatch implements Dispatcher
+// It must not be called concurrently, the Server calls it from a single goroutine
+func (dispatcher *LatencyDispatcher) Dispatch(pools []*Pool, request *ConnectionRequest) *Connection {
+	var total, reported int64
+	for _, pool := range pools {
+		if latency := atomic.LoadInt64(&pool.latency); latency >= 0 {
+			total += latency
+			reported++
+		}
+	}
+	average := int64(0)
+	if reported > 0 {
+		average = total / reported
+	}
+
+	return weightedDispatch(dispatcher.rand, pools, request, func(pool *Pool) int {
+		latency := atomic.LoadInt64(&pool.latency)
+		if latency < 0 {
+			latency = average
+		}
+		// Pools slower than 1000 s still get a chance to be picked
+		if weight := int(1000000 / (latency + 1)); weight > 0 {
+			return weight
+		}
+		return 1
+	})
+}
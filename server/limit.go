@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// limited runs the handler once one of the Config.MaxConcurrentRequests slots is free rather than
+// queueing the requests in the dispatcher, at most Config.RequestQueueSize requests wait for a slot
+// and the following ones are shed with 503. A waiting request gives up as soon as its client goes away.
+func (server *Server) limited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if server.slots == nil {
+			handler(w, r)
+			return
+		}
+
+		select {
+		case server.slots <- struct{}{}:
+		default:
+			if !server.waitSlot(r) {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Too many concurrent requests", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		defer func() { <-server.slots }()
+
+		handler(w, r)
+	}
+}
+
+// waitSlot waits for a free slot if the queue is not full
+// It returns false if the queue is full or the request has been canceled
+func (server *Server) waitSlot(r *http.Request) bool {
+	defer atomic.AddInt64(&server.waiting, -1)
+	if atomic.AddInt64(&server.waiting, 1) > int64(server.Config.RequestQueueSize) {
+		return false
+	}
+
+	select {
+	case server.slots <- struct{}{}:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimited(t *testing.T) {
+	config := NewConfig()
+	config.MaxConcurrentRequests = 1
+	config.RequestQueueSize = 1
+	server := NewServer(config)
+	server.SetLogOutput(ioutil.Discard)
+
+	started := make(chan struct{}, 2)
+	unblock := make(chan struct{})
+	handler := server.limited(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+	})
+
+	// The first request takes the slot
+	first := make(chan struct{})
+	go func() {
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/request", nil))
+		close(first)
+	}()
+	<-started
+
+	// The second one waits for the slot until its client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	second := make(chan struct{})
+	go func() {
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/request", nil).WithContext(ctx))
+		close(second)
+	}()
+	for atomic.LoadInt64(&server.waiting) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The third one is shed as the queue is full
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/request", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503, got %d", recorder.Code)
+	}
+	if recorder.Header().Get("Retry-After") == "" {
+		t.Fatal("Missing Retry-After header")
+	}
+
+	cancel()
+	select {
+	case <-second:
+	case <-time.After(time.Second):
+		t.Fatal("The waiting request didn't give up once canceled")
+	}
+	select {
+	case <-started:
+		t.Fatal("The canceled request was processed")
+	default:
+	}
+
+	close(unblock)
+	<-first
+	if waiting := atomic.LoadInt64(&server.waiting); waiting != 0 {
+		t.Fatalf("%d requests still waiting", waiting)
+	}
+	if len(server.slots) != 0 {
+		t.Fatalf("%d slots still taken", len(server.slots))
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/root-gg/wsp/common"
+)
+
+// SetLogOutput sends the Server logs to the writer instead of the standard logger
+// ( a file with its own rotation, a syslog writer, ... ), it must be called before Start
+func (server *Server) SetLogOutput(w io.Writer) {
+	server.logger = log.New(server.redact(w), "", log.LstdFlags)
+}
+
+// redact wraps the log output to redact Config.RedactQueryParams and Config.RedactPatterns
+func (server *Server) redact(w io.Writer) io.Writer {
+	if len(server.Config.RedactQueryParams) == 0 && len(server.Config.RedactPatterns) == 0 {
+		return w
+	}
+	redactor, err := common.NewRedactor(w, server.Config.RedactQueryParams, server.Config.RedactPatterns)
+	if err != nil {
+		log.Printf("Unable to redact logs : %s", err)
+		return w
+	}
+	return redactor
+}
+
+// proxyError log error and return a HTTP 526 error with the message
+func (server *Server) proxyError(w http.ResponseWriter, err error) {
+	server.proxyErrorStatus(w, 526, err)
+}
+
+// proxyErrorf log error and return a HTTP 526 error with the message
+func (server *Server) proxyErrorf(w http.ResponseWriter, format string, args ...interface{}) {
+	server.proxyError(w, fmt.Errorf(format, args...))
+}
+
+// proxyErrorStatus log error and return a HTTP error with the status code and the message
+func (server *Server) proxyErrorStatus(w http.ResponseWriter, status int, err error) {
+	server.logger.Println(err)
+	http.Error(w, err.Error(), status)
+}
+
+// logf logs a message prefixed with the tuple identifying the connection, the generation
+// is the Server creation time so that connection ids are unique across restarts
+func (connection *Connection) logf(format string, args ...interface{}) {
+	server := connection.pool.server
+	prefix := fmt.Sprintf("[pool=%s name=%s connection=%d generation=%d] ", connection.pool.id, connection.settings.Name, connection.id, server.generation)
+	server.logger.Printf(prefix+format, args...)
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errLoop is returned by checkLoop when a request would loop through the Server
+var errLoop = errors.New("Request loop detected")
+
+// checkLoop rejects requests to the Server itself and requests that went through more than
+// Config.MaxHops Servers, then increments the X-PROXY-HOPS header forwarded to the backend
+// so that a destination pointing back at a Server is detected on the next hop
+func (server *Server) checkLoop(r *http.Request) (err error) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	destination := canonicalHost(r.URL.Host, r.URL.Scheme)
+	if destination == canonicalHost(r.Host, scheme) || destination == canonicalHost(net.JoinHostPort(server.Config.Host, strconv.Itoa(server.Config.Port)), scheme) {
+		return fmt.Errorf("%w : destination is the WSP server itself", errLoop)
+	}
+
+	hops := 0
+	if header := r.Header.Get("X-PROXY-HOPS"); header != "" {
+		hops, err = strconv.Atoi(header)
+		if err != nil || hops < 0 {
+			return errors.New("Invalid X-PROXY-HOPS header")
+		}
+	}
+	if max := server.Config.MaxHops; max > 0 && hops >= max {
+		return fmt.Errorf("%w : %d hops", errLoop, hops)
+	}
+
+	r.Header.Set("X-PROXY-HOPS", strconv.Itoa(hops+1))
+	return nil
+}
+
+// canonicalHost returns the lower cased host:port of the host so that hosts with and without
+// the default port of the scheme are equal ( example.com and example.com:443 for https )
+func canonicalHost(host string, scheme string) string {
+	host = strings.ToLower(host)
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	port := "80"
+	if scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), port)
+}
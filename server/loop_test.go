@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCanonicalHost(t *testing.T) {
+	for _, test := range []struct {
+		host      string
+		scheme    string
+		canonical string
+	}{
+		{"example.com", "http", "example.com:80"},
+		{"example.com", "https", "example.com:443"},
+		{"EXAMPLE.com:443", "https", "example.com:443"},
+		{"example.com:8080", "https", "example.com:8080"},
+		{"[::1]", "http", "[::1]:80"},
+		{"[::1]:8080", "http", "[::1]:8080"},
+	} {
+		if canonical := canonicalHost(test.host, test.scheme); canonical != test.canonical {
+			t.Errorf("canonicalHost(%q, %q) = %q, expected %q", test.host, test.scheme, canonical, test.canonical)
+		}
+	}
+}
+
+func TestCheckLoop(t *testing.T) {
+	config := NewConfig()
+	config.Host = "127.0.0.1"
+	config.Port = 8080
+	server := NewServer(config)
+
+	for _, test := range []struct {
+		host        string
+		tls         bool
+		destination string
+		loop        bool
+	}{
+		{"wsp.example.com", false, "http://wsp.example.com:80/request", true},
+		{"wsp.example.com:443", true, "https://WSP.example.com/request", true},
+		{"wsp.example.com", true, "https://wsp.example.com:443/request", true},
+		{"wsp.example.com", false, "https://wsp.example.com/request", false},
+		{"wsp.example.com", false, "http://127.0.0.1:8080/request", true},
+		{"wsp.example.com", false, "http://backend.example.com/", false},
+	} {
+		r := httptest.NewRequest("GET", "/request", nil)
+		r.Host = test.host
+		if test.tls {
+			r.TLS = new(tls.ConnectionState)
+		}
+		URL, err := url.Parse(test.destination)
+		if err != nil {
+			t.Fatalf("Unable to parse %s : %s", test.destination, err)
+		}
+		r.URL = URL
+
+		err = server.checkLoop(r)
+		if loop := errors.Is(err, errLoop); loop != test.loop {
+			t.Errorf("Host %s, destination %s : loop %t, expected %t ( %v )", test.host, test.destination, loop, test.loop, err)
+		}
+	}
+}
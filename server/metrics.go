@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the proxy latency histogram in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics are the Prometheus metrics of the Server, enabled by Config.MetricsEnabled
+// They are exposed on /metrics in the Prometheus text format
+type Metrics struct {
+	lock sync.Mutex
+
+	requests int64            // Requests sent through a websocket connection
+	failures map[string]int64 // Tunnel failures by failure category
+
+	latencyBuckets []int64 // Non cumulative count of each latency bucket, the last one is +Inf
+	latencySum     float64
+	latencyCount   int64
+}
+
+// NewMetrics creates a new Metrics
+func NewMetrics() (metrics *Metrics) {
+	metrics = new(Metrics)
+	metrics.failures = make(map[string]int64)
+	metrics.latencyBuckets = make([]int64, len(latencyBuckets)+1)
+	return
+}
+
+// request records a request proxied through a websocket connection and its latency
+func (metrics *Metrics) request(latency time.Duration) {
+	if metrics == nil {
+		return
+	}
+
+	seconds := latency.Seconds()
+	bucket := sort.SearchFloat64s(latencyBuckets, seconds)
+
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+
+	metrics.requests++
+	metrics.latencyBuckets[bucket]++
+	metrics.latencySum += seconds
+	metrics.latencyCount++
+}
+
+// failure records a tunnel failure of the category
+func (metrics *Metrics) failure(failure string) {
+	if metrics == nil {
+		return
+	}
+
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+
+	metrics.failures[failure]++
+}
+
+// labelEscaper escapes label values of the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metrics writes the metrics and the connections of every pool in the Prometheus text format
+func (server *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	metrics := server.Metrics
+	if metrics == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metrics.lock.Lock()
+	fmt.Fprintf(w, "# HELP wsp_requests_total Requests sent through a websocket connection.\n")
+	fmt.Fprintf(w, "# TYPE wsp_requests_total counter\n")
+	fmt.Fprintf(w, "wsp_requests_total %d\n", metrics.requests)
+
+	fmt.Fprintf(w, "# HELP wsp_failures_total Requests that failed in the tunnel by failure category.\n")
+	fmt.Fprintf(w, "# TYPE wsp_failures_total counter\n")
+	for _, failure := range []string{FailureNoPool, FailureTimeout, FailureDial, FailureProtocol} {
+		fmt.Fprintf(w, "wsp_failures_total{failure=%q} %d\n", failure, metrics.failures[failure])
+	}
+
+	fmt.Fprintf(w, "# HELP wsp_proxy_duration_seconds Time to proxy a request through a websocket connection.\n")
+	fmt.Fprintf(w, "# TYPE wsp_proxy_duration_seconds histogram\n")
+	var cumulative int64
+	for i, le := range latencyBuckets {
+		cumulative += metrics.latencyBuckets[i]
+		fmt.Fprintf(w, "wsp_proxy_duration_seconds_bucket{le=\"%g\"} %d\n", le, cumulative)
+	}
+	fmt.Fprintf(w, "wsp_proxy_duration_seconds_bucket{le=\"+Inf\"} %d\n", metrics.latencyCount)
+	fmt.Fprintf(w, "wsp_proxy_duration_seconds_sum %g\n", metrics.latencySum)
+	fmt.Fprintf(w, "wsp_proxy_duration_seconds_count %d\n", metrics.latencyCount)
+	metrics.lock.Unlock()
+
+	// Tenant counters are bounded by Config.MaxTenants
+	if tenants := server.stats.Snapshot().Tenants; len(tenants) > 0 {
+		fmt.Fprintf(w, "# HELP wsp_tenant_requests_total Requests by X-PROXY-TENANT header.\n")
+		fmt.Fprintf(w, "# TYPE wsp_tenant_requests_total counter\n")
+		for tenant, requests := range tenants {
+			fmt.Fprintf(w, "wsp_tenant_requests_total{tenant=\"%s\"} %d\n", labelEscaper.Replace(tenant), requests)
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP wsp_pool_connections Websocket connections of the remote Proxies by state.\n")
+	fmt.Fprintf(w, "# TYPE wsp_pool_connections gauge\n")
+	server.lock.RLock()
+	for _, pool := range server.pools {
+		ps := pool.Size()
+		labels := fmt.Sprintf("pool=\"%s\",name=\"%s\"", labelEscaper.Replace(pool.id), labelEscaper.Replace(pool.Settings().Name))
+		fmt.Fprintf(w, "wsp_pool_connections{%s,state=\"idle\"} %d\n", labels, ps.Idle)
+		fmt.Fprintf(w, "wsp_pool_connections{%s,state=\"busy\"} %d\n", labels, ps.Busy)
+	}
+	server.lock.RUnlock()
+}
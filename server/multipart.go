@@ -0,0 +1,150 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// checkMultipart validates multipart requests against Config.MultipartMaxParts and Config.MultipartMaxPartSize
+// The body is validated while it is forwarded rather than buffered : reading it fails with an InvalidBodyError
+// as soon as a limit is exceeded, aborting the upload mid-stream. The returned function stops the validation.
+func (server *Server) checkMultipart(r *http.Request) (cleanup func()) {
+	cleanup = func() {}
+
+	maxParts := server.Config.MultipartMaxParts
+	maxPartSize := server.Config.MultipartMaxPartSize
+	if maxParts <= 0 && maxPartSize <= 0 {
+		return
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return
+	}
+
+	body := newMultipartBody(r.Body, params["boundary"], maxParts, maxPartSize)
+	r.Body = body
+	return body.stop
+}
+
+// InvalidBodyError is returned while reading a request body which fails the validation,
+// the remote Proxy is not to blame for the failed request
+type InvalidBodyError struct {
+	err error
+}
+
+func (e *InvalidBodyError) Error() string {
+	return e.err.Error()
+}
+
+// errValidationStopped stops the validation of bodies which are not read until the end
+var errValidationStopped = errors.New("Validation stopped")
+
+// multipartBody validates a multipart request body as it is read
+// The bytes read are piped to a goroutine parsing the parts, only its buffer is held in memory.
+type multipartBody struct {
+	body   io.ReadCloser
+	pipe   *io.PipeWriter
+	result chan error
+	err    error // Returned by every following Read once the body is done or invalid
+}
+
+// newMultipartBody starts the validation of the body
+func newMultipartBody(body io.ReadCloser, boundary string, maxParts int, maxPartSize int64) (mb *multipartBody) {
+	mb = new(multipartBody)
+	mb.body = body
+	mb.result = make(chan error, 1)
+
+	reader, writer := io.Pipe()
+	mb.pipe = writer
+	go func() {
+		err := validateMultipart(reader, boundary, maxParts, maxPartSize)
+		if err == nil {
+			// Consume the epilogue
+			_, err = io.Copy(ioutil.Discard, reader)
+		}
+		if err != nil {
+			err = &InvalidBodyError{err}
+		}
+		reader.CloseWithError(err)
+		mb.result <- err
+	}()
+	return
+}
+
+// Read implements io.Reader, it fails once the body is found invalid
+func (mb *multipartBody) Read(p []byte) (n int, err error) {
+	if mb.err != nil {
+		return 0, mb.err
+	}
+
+	n, err = mb.body.Read(p)
+	if n > 0 {
+		if _, werr := mb.pipe.Write(p[:n]); werr != nil {
+			// The validation failed before the end of the body
+			mb.err = <-mb.result
+			return 0, mb.err
+		}
+	}
+	if err == io.EOF {
+		// Wait for the last part to be validated
+		mb.pipe.Close()
+		if verr := <-mb.result; verr != nil {
+			mb.err = verr
+			return 0, verr
+		}
+		mb.err = io.EOF
+	}
+	return
+}
+
+// Close implements io.Closer
+func (mb *multipartBody) Close() error {
+	mb.stop()
+	return mb.body.Close()
+}
+
+// stop the validation goroutine if the body is not read until the end
+func (mb *multipartBody) stop() {
+	mb.pipe.CloseWithError(errValidationStopped)
+}
+
+// validateMultipart reads the parts of the multipart body until a limit is exceeded
+func validateMultipart(r io.Reader, boundary string, maxParts int, maxPartSize int64) error {
+	reader := multipart.NewReader(r, boundary)
+	for parts := 1; ; parts++ {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid multipart body : %s", err)
+		}
+
+		if maxParts > 0 && parts > maxParts {
+			return fmt.Errorf("Too many parts in multipart body ( max %d )", maxParts)
+		}
+
+		var size int64
+		if maxPartSize > 0 {
+			size, err = io.Copy(ioutil.Discard, io.LimitReader(part, maxPartSize+1))
+		} else {
+			size, err = io.Copy(ioutil.Discard, part)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid multipart body : %s", err)
+		}
+		if maxPartSize > 0 && size > maxPartSize {
+			return fmt.Errorf("Multipart body part is too large ( max %d bytes )", maxPartSize)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestMultipart returns a multipart body with a part of each size and its content type
+func newTestMultipart(t testing.TB, sizes ...int) ([]byte, string) {
+	buffer := new(bytes.Buffer)
+	writer := multipart.NewWriter(buffer)
+	for i, size := range sizes {
+		part, err := writer.CreateFormFile("file", strings.Repeat("f", i+1))
+		if err != nil {
+			t.Fatalf("Unable to create part : %s", err)
+		}
+		part.Write(bytes.Repeat([]byte("x"), size))
+	}
+	writer.Close()
+	return buffer.Bytes(), writer.FormDataContentType()
+}
+
+func TestCheckMultipart(t *testing.T) {
+	config := NewConfig()
+	config.MultipartMaxParts = 2
+	config.MultipartMaxPartSize = 1024
+	server := NewServer(config)
+
+	for _, test := range []struct {
+		sizes []int
+		valid bool
+	}{
+		{[]int{10}, true},
+		{[]int{1024, 1024}, true},
+		{[]int{10, 10, 10}, false},
+		{[]int{10, 100000}, false},
+	} {
+		body, contentType := newTestMultipart(t, test.sizes...)
+		r := httptest.NewRequest("POST", "/request", bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+
+		stop := server.checkMultipart(r)
+		forwarded, err := ioutil.ReadAll(r.Body)
+		stop()
+
+		_, invalid := err.(*InvalidBodyError)
+		if err != nil && !invalid {
+			t.Fatalf("Parts %v : unexpected error %s", test.sizes, err)
+		}
+		if invalid == test.valid {
+			t.Fatalf("Parts %v : expected valid %t, got error %v", test.sizes, test.valid, err)
+		}
+		if test.valid && !bytes.Equal(forwarded, body) {
+			t.Fatalf("Parts %v : body modified", test.sizes)
+		}
+	}
+}
+
+// TestCheckMultipartStreaming checks that an oversized part is rejected before the end of the body
+func TestCheckMultipartStreaming(t *testing.T) {
+	config := NewConfig()
+	config.MultipartMaxPartSize = 1024
+	server := NewServer(config)
+
+	body, contentType := newTestMultipart(t, 10<<20)
+	r := httptest.NewRequest("POST", "/request", bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	defer server.checkMultipart(r)()
+
+	read, err := io.Copy(ioutil.Discard, r.Body)
+	if _, ok := err.(*InvalidBodyError); !ok {
+		t.Fatalf("Expected an invalid body error, got %v", err)
+	}
+	if read > 1<<20 {
+		t.Fatalf("%d bytes were read before the part was rejected", read)
+	}
+}
+
+func TestProxyInvalidMultipart(t *testing.T) {
+	received := make(chan int64, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := io.Copy(ioutil.Discard, r.Body)
+		received <- size
+	}))
+	defer backend.Close()
+
+	config := NewConfig()
+	config.MultipartMaxParts = 1
+	server := newTestServer(t, config)
+	newTestClient(t, server, newTestClientConfig())
+
+	body, contentType := newTestMultipart(t, 10, 10)
+	req, err := http.NewRequest("POST", "http://"+server.Addr().String()+"/request", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Unable to create request : %s", err)
+	}
+	req.Header.Set("X-PROXY-DESTINATION", backend.URL)
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unable to proxy request : %s", err)
+	}
+	message, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK || !strings.Contains(string(message), "Too many parts") {
+		t.Fatalf("Invalid multipart body forwarded : %d %s", resp.StatusCode, message)
+	}
+	select {
+	case size := <-received:
+		if size == int64(len(body)) {
+			t.Fatal("The backend received the whole invalid body")
+		}
+	default:
+	}
+
+	// The remote Proxy is not blamed for the invalid body
+	resp = proxy(t, server, "GET", backend.URL, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d after an invalid body", resp.StatusCode)
+	}
+}
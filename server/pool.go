@@ -1,11 +1,14 @@
 package server
 
 import (
-	"log"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp/common"
 )
 
 // Pool handle all connections from a remote Proxy
@@ -13,13 +16,24 @@ type Pool struct {
 	server *Server
 	id     string
 
-	size int
+	settings atomic.Value // *common.ClientSettings of the last registered connection
+	latency  int64        // Median backend latency reported by the remote Proxy in milliseconds, -1 if unknown
+	requests int64        // Requests proxied by the pool, control requests excluded
+	pushed   int64        // Requests dispatched to the pool at the previous stats push
+
+	breaker *CircuitBreaker
 
 	connections []*Connection
+	reserved    int // Places reserved for connections being acknowledged
 	idle        chan *Connection
 
-	done bool
-	lock sync.RWMutex
+	offers    []*Connection
+	offered   chan struct{}
+	offerLock sync.Mutex
+
+	done     bool
+	shutdown chan struct{}
+	lock     sync.RWMutex
 }
 
 // NewPool creates a new Pool
@@ -27,30 +41,208 @@ func NewPool(server *Server, id string) (pool *Pool) {
 	pool = new(Pool)
 	pool.server = server
 	pool.id = id
+	pool.settings.Store(&common.ClientSettings{ID: id})
+	pool.latency = -1
 	pool.idle = make(chan *Connection)
+	pool.offered = make(chan struct{}, 1)
+	pool.shutdown = make(chan struct{})
+	pool.breaker = NewCircuitBreaker(id, server.Config.CircuitBreakerThreshold, time.Duration(server.Config.CircuitBreakerCooldown)*time.Millisecond, server.logger)
+
+	go pool.offer()
+
 	return
 }
 
-// Register creates a new Connection and adds it to the pool
-func (pool *Pool) Register(ws *websocket.Conn) {
+// reserve a place in the pool for a connection to register
+// An error is returned if the pool already has Config.MaxPoolConnections connections
+// A pool with reserved places is not empty so it is not garbage collected meanwhile.
+func (pool *Pool) reserve() (err error) {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
 
 	// Ensure we never add a connection to a pool we have garbage collected
 	if pool.done {
-		return
+		return fmt.Errorf("Pool %s has been removed", pool.id)
+	}
+
+	max := pool.server.Config.MaxPoolConnections
+	if max > 0 {
+		pool.Clean()
+		if len(pool.connections)+pool.reserved >= max {
+			return fmt.Errorf("Too many connections from %s ( max %d )", pool.id, max)
+		}
+	}
+
+	pool.reserved++
+	return
+}
+
+// Register creates a new Connection and adds it to the pool in the place reserved by reserve()
+// The connection uses the settings of its own greeting as the pool settings may be
+// replaced by another connection meanwhile. The caller closes ws if an error is returned.
+func (pool *Pool) Register(ws *websocket.Conn, settings *common.ClientSettings) (err error) {
+	// Acknowledge the greeting before the connection can be dispatched
+	// The network write is done without lock not to block the pool meanwhile
+	err = acknowledgeGreeting(ws)
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.reserved--
+	if err != nil {
+		return fmt.Errorf("Unable to acknowledge greeting message : %s", err)
+	}
+
+	// The pool may have been shut down while the greeting was acknowledged
+	if pool.done {
+		return fmt.Errorf("Pool %s has been removed", pool.id)
 	}
 
-	log.Printf("Registering new connection from %s", pool.id)
-	connection := NewConnection(pool, ws)
+	connection := NewConnection(pool, ws, settings)
+	connection.logf("Registering new connection ( protocol %s )", connection.protocol)
 	pool.connections = append(pool.connections, connection)
 
 	return
 }
 
+// ID returns the remote Proxy id
+func (pool *Pool) ID() string {
+	return pool.id
+}
+
+// Settings returns the settings of the remote Proxy
+// The returned settings MUST NOT be modified
+func (pool *Pool) Settings() *common.ClientSettings {
+	return pool.settings.Load().(*common.ClientSettings)
+}
+
+// setSettings replaces the settings of the remote Proxy when it registers a connection
+// Connections keep the settings they were registered with, the new ones only apply
+// to the next registered connections and to the pool wide logic ( pool size, body size )
+// This MUST be surrounded by server.lock.Lock()
+func (pool *Pool) setSettings(settings *common.ClientSettings) {
+	previous := pool.Settings()
+	if previous.PoolSize != 0 && previous.PoolSize != settings.PoolSize {
+		pool.server.logger.Printf("Pool size of %s changed from %d to %d", pool.id, previous.PoolSize, settings.PoolSize)
+	}
+	pool.settings.Store(settings)
+}
+
+// Idle returns the channel the idle connections of the pool are offered on
+func (pool *Pool) Idle() <-chan *Connection {
+	return pool.idle
+}
+
+// idleWait is the maximum time takeIdle waits for the offer goroutine to offer an idle connection
+const idleWait = 10 * time.Millisecond
+
+// takeIdle takes an idle connection of the pool without going through the dispatcher
+// It returns nil if no connection is idle
+func (pool *Pool) takeIdle() *Connection {
+	for {
+		var connection *Connection
+		select {
+		case connection = <-pool.idle:
+		default:
+			// The offer goroutine may be between two offers
+			if pool.Size().Idle == 0 {
+				return nil
+			}
+			select {
+			case connection = <-pool.idle:
+			case <-time.After(idleWait):
+				return nil
+			}
+		}
+		if connection.Take() {
+			return connection
+		}
+	}
+}
+
 // Offer an idle connection to the server
+// Offered connections are queued and handed to the dispatcher by the offer() goroutine
 func (pool *Pool) Offer(connection *Connection) {
-	go func() { pool.idle <- connection }()
+	pool.offerLock.Lock()
+	pool.offers = append(pool.offers, connection)
+	pool.offerLock.Unlock()
+
+	select {
+	case pool.offered <- struct{}{}:
+	default:
+	}
+}
+
+// offer hands the queued connections to the dispatcher one at a time
+// A single goroutine per pool avoids spawning one goroutine per offer.
+// The offer is withdrawn if the connection is closed before being taken
+// so that closed connections are never dispatched.
+//
+// Connections are offered in release order, the one idle for the longest time first ( LRU )
+// so that every connection is exercised before reaching the idle timeout. With the "mru"
+// Config.IdleSelection the most recently released connection is offered first instead
+// and the pending offer is withdrawn when a connection is released, letting the least
+// used connections reach the idle timeout to shrink the pool.
+func (pool *Pool) offer() {
+	mru := pool.server.Config.IdleSelection == "mru"
+	for {
+		var connection *Connection
+		var older int // Number of queued connections released before the offered one
+		pool.offerLock.Lock()
+		if len(pool.offers) > 0 {
+			if mru {
+				connection = pool.offers[len(pool.offers)-1]
+				pool.offers = pool.offers[:len(pool.offers)-1]
+				older = len(pool.offers)
+			} else {
+				connection = pool.offers[0]
+				pool.offers = pool.offers[1:]
+			}
+		}
+		pool.offerLock.Unlock()
+
+		if connection == nil {
+			select {
+			case <-pool.offered:
+			case <-pool.shutdown:
+				return
+			}
+			continue
+		}
+
+		var released chan struct{}
+		if mru {
+			released = pool.offered
+		}
+
+		select {
+		case pool.idle <- connection:
+		case <-connection.closed:
+		case <-released:
+			// Queue the pending connection back before the newly released ones
+			pool.offerLock.Lock()
+			pool.offers = append(pool.offers, nil)
+			copy(pool.offers[older+1:], pool.offers[older:])
+			pool.offers[older] = connection
+			pool.offerLock.Unlock()
+		case <-pool.shutdown:
+			return
+		}
+	}
+}
+
+// CanHandle returns true if the remote Proxy accepts the request
+func (pool *Pool) CanHandle(request *ConnectionRequest) bool {
+	if request.poolID != "" && request.poolID != pool.id {
+		return false
+	}
+	if !pool.breaker.Allow() {
+		return false
+	}
+	if maxBodySize := pool.Settings().MaxBodySize; maxBodySize > 0 && request.contentLength > maxBodySize {
+		return false
+	}
+	return true
 }
 
 // Clean removes dead connection from the pool
@@ -60,21 +252,31 @@ func (pool *Pool) Clean() {
 	idle := 0
 	var connections []*Connection
 
+	idleTimeout := pool.server.Config.IdleTimeout.Duration()
+	maxBusyTime := time.Duration(pool.server.Config.MaxBusyTime) * time.Millisecond
+	size := pool.Settings().PoolSize
 	for _, connection := range pool.connections {
 		// We need to be sur we'll never close a BUSY or soon to be BUSY connection
 		connection.lock.Lock()
 		if connection.status == IDLE {
 			idle++
-			if idle > pool.size {
+			if idle > size {
 				// We have enough idle connections in the pool.
 				// Terminate the connection if it is idle since more that IdleTimeout
-				if int(time.Now().Sub(connection.idleSince).Seconds())*1000 > pool.server.Config.IdleTimeout {
-					connection.close()
+				if time.Since(connection.idleSince) > idleTimeout {
+					connection.close(common.CloseIdleTimeout)
 				}
 			}
+		} else if connection.status == BUSY && maxBusyTime > 0 {
+			// Reclaim connections wedged BUSY, the pending request fails
+			// as soon as the websocket is closed
+			if time.Since(connection.busySince) > maxBusyTime {
+				connection.close(common.CloseBusyTimeout)
+			}
 		}
+		closed := connection.status == CLOSED
 		connection.lock.Unlock()
-		if connection.status == CLOSED {
+		if closed {
 			continue
 		}
 		connections = append(connections, connection)
@@ -83,12 +285,14 @@ func (pool *Pool) Clean() {
 }
 
 // IsEmpty clean the pool and return true if the pool is empty
+// Only CLOSED connections are removed so a pool with idle
+// or busy ( in-flight ) connections is never reported empty
 func (pool *Pool) IsEmpty() bool {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
 
 	pool.Clean()
-	return len(pool.connections) == 0
+	return len(pool.connections) == 0 && pool.reserved == 0
 }
 
 // Shutdown closes every connections in the pool and cleans it
@@ -96,10 +300,13 @@ func (pool *Pool) Shutdown() {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
 
-	pool.done = true
+	if !pool.done {
+		pool.done = true
+		close(pool.shutdown)
+	}
 
 	for _, connection := range pool.connections {
-		connection.Close()
+		connection.Close(common.CloseShutdown)
 	}
 	pool.Clean()
 }
@@ -118,11 +325,12 @@ func (pool *Pool) Size() (ps *PoolSize) {
 
 	ps = new(PoolSize)
 	for _, connection := range pool.connections {
-		if connection.status == IDLE {
+		status := connection.getStatus()
+		if status == IDLE {
 			ps.Idle++
-		} else if connection.status == BUSY {
+		} else if status == BUSY {
 			ps.Busy++
-		} else if connection.status == CLOSED {
+		} else if status == CLOSED {
 			ps.Closed++
 		}
 	}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp/common"
+)
+
+// pipeListener is a net.Listener of in-memory connections created by Dial
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// Accept implements net.Listener
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("Listener closed")
+	}
+}
+
+// Close implements net.Listener
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+// Addr implements net.Listener
+func (l *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "pipe"}
+}
+
+// Dial returns the client side of a new in-memory connection
+func (l *pipeListener) Dial(network string, address string) (net.Conn, error) {
+	server, client := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, errors.New("Listener closed")
+	}
+}
+
+// testWebsockets creates websocket connections over in-memory connections
+type testWebsockets struct {
+	listener *pipeListener
+	dialer   *websocket.Dialer
+	upgraded chan *websocket.Conn
+}
+
+// newTestWebsockets starts a websocket server, it is closed at the end of the test
+func newTestWebsockets(t testing.TB) *testWebsockets {
+	tw := new(testWebsockets)
+	tw.listener = newPipeListener()
+	tw.dialer = &websocket.Dialer{NetDial: tw.listener.Dial}
+	tw.upgraded = make(chan *websocket.Conn)
+
+	upgrader := websocket.Upgrader{}
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		tw.upgraded <- ws
+	})}
+	go backend.Serve(tw.listener)
+	t.Cleanup(func() { backend.Close() })
+
+	return tw
+}
+
+// connect returns the server side of a new websocket connection, peer is run on the
+// remote side in its own goroutine and the connection is closed once it returns
+func (tw *testWebsockets) connect(peer func(*websocket.Conn)) (*websocket.Conn, error) {
+	remote, _, err := tw.dialer.Dial("ws://pipe/register", nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to dial websocket : %s", err)
+	}
+	go func() {
+		defer remote.Close()
+		peer(remote)
+	}()
+
+	return <-tw.upgraded, nil
+}
+
+// discardPeer reads every message until the connection is closed
+func discardPeer(ws *websocket.Conn) {
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// TestPoolConcurrentCleanOfferRegister registers, takes, releases and cleans connections concurrently
+// Every registered connection must either be closed or still be in the pool and offered exactly once
+func TestPoolConcurrentCleanOfferRegister(t *testing.T) {
+	config := NewConfig()
+	config.IdleTimeout = 1
+	server := NewServer(config)
+	server.SetLogOutput(ioutil.Discard)
+
+	pool := NewPool(server, "test")
+	pool.setSettings(&common.ClientSettings{ID: "test", PoolSize: 2})
+	t.Cleanup(pool.Shutdown)
+
+	websockets := newTestWebsockets(t)
+
+	const registers = 4
+	const connections = 25
+
+	seen := make(map[*Connection]bool)
+	stop := make(chan struct{})
+	var workers sync.WaitGroup
+
+	// Clean the pool in a loop, every connection it may remove is recorded first
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		for {
+			pool.lock.Lock()
+			for _, connection := range pool.connections {
+				seen[connection] = true
+			}
+			pool.Clean()
+			pool.lock.Unlock()
+
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+
+	// Take and release the offered connections
+	for i := 0; i < 4; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				select {
+				case connection := <-pool.Idle():
+					if connection.Take() {
+						time.Sleep(time.Millisecond)
+						connection.Release()
+					}
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	var registered sync.WaitGroup
+	for i := 0; i < registers; i++ {
+		registered.Add(1)
+		go func() {
+			defer registered.Done()
+			for j := 0; j < connections; j++ {
+				ws, err := websockets.connect(discardPeer)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := pool.reserve(); err != nil {
+					t.Errorf("Unable to reserve connection : %s", err)
+					return
+				}
+				if err := pool.Register(ws, pool.Settings()); err != nil {
+					t.Errorf("Unable to register connection : %s", err)
+					return
+				}
+			}
+		}()
+	}
+	registered.Wait()
+
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	workers.Wait()
+
+	pool.lock.Lock()
+	for _, connection := range pool.connections {
+		seen[connection] = true
+	}
+	pool.Clean()
+	remaining := append([]*Connection(nil), pool.connections...)
+	pool.lock.Unlock()
+
+	if len(seen) != registers*connections {
+		t.Fatalf("Expected %d registered connections, got %d", registers*connections, len(seen))
+	}
+
+	inPool := make(map[*Connection]bool)
+	for _, connection := range remaining {
+		if inPool[connection] {
+			t.Fatalf("Connection %d is duplicated in the pool", connection.ID())
+		}
+		inPool[connection] = true
+	}
+	for connection := range seen {
+		if !inPool[connection] && connection.getStatus() != CLOSED {
+			t.Fatalf("Connection %d was lost", connection.ID())
+		}
+	}
+
+	// Every connection left in the pool is idle and must be offered exactly once
+	offered := make(map[*Connection]bool)
+	for len(offered) < len(remaining) {
+		select {
+		case connection := <-pool.Idle():
+			if !inPool[connection] {
+				// A closed connection may still be offered, Take() rejects it
+				if connection.getStatus() != CLOSED {
+					t.Fatalf("Connection %d offered but not in the pool", connection.ID())
+				}
+				continue
+			}
+			if offered[connection] {
+				t.Fatalf("Connection %d offered twice", connection.ID())
+			}
+			offered[connection] = true
+		case <-time.After(time.Second):
+			t.Fatalf("Only %d of the %d idle connections were offered", len(offered), len(remaining))
+		}
+	}
+}
+
+func TestRegisterKeepsGreetingSettings(t *testing.T) {
+	pool := newTestPool(t, NewConfig())
+	websockets := newTestWebsockets(t)
+
+	ws, err := websockets.connect(discardPeer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := &common.ClientSettings{ID: "test", PoolSize: 1, Encoding: common.BinaryEncoding, Checksum: true}
+	pool.setSettings(settings)
+	if err := pool.reserve(); err != nil {
+		t.Fatalf("Unable to reserve connection : %s", err)
+	}
+
+	// Another connection greets with other settings before the first one is registered
+	pool.setSettings(&common.ClientSettings{ID: "test", PoolSize: 1, Encoding: common.JSONEncoding})
+
+	if err := pool.Register(ws, settings); err != nil {
+		t.Fatalf("Unable to register connection : %s", err)
+	}
+	connection := pool.takeIdle()
+	if connection == nil {
+		t.Fatal("No idle connection")
+	}
+	if connection.settings != settings {
+		t.Fatalf("Connection registered with settings %+v, expected %+v", connection.settings, settings)
+	}
+}
+
+func TestRegisterAfterShutdown(t *testing.T) {
+	pool := newTestPool(t, NewConfig())
+	websockets := newTestWebsockets(t)
+
+	ws, err := websockets.connect(discardPeer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.reserve(); err != nil {
+		t.Fatalf("Unable to reserve connection : %s", err)
+	}
+
+	// The pool is shut down while the greeting is acknowledged
+	pool.Shutdown()
+
+	err = pool.Register(ws, pool.Settings())
+	ws.Close()
+	if err == nil {
+		t.Fatal("A connection was registered in a removed pool")
+	}
+	if len(pool.connections) != 0 || pool.reserved != 0 {
+		t.Fatalf("Pool has %d connections and %d reserved places after shutdown", len(pool.connections), pool.reserved)
+	}
+}
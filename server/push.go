@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/root-gg/wsp/common"
+)
+
+// pushStats sends every Config.StatsPushInterval each remote Proxy the statistics of its pool
+func (server *Server) pushStats() {
+	interval := time.Duration(server.Config.StatsPushInterval) * time.Millisecond
+	for {
+		select {
+		case <-server.done:
+			return
+		case <-time.After(interval):
+		}
+
+		server.lock.RLock()
+		pools := make([]*Pool, len(server.pools))
+		copy(pools, server.pools)
+		server.lock.RUnlock()
+
+		for _, pool := range pools {
+			// Only push to remote Proxies handling control requests
+			if !pool.Settings().Control {
+				continue
+			}
+			err := server.sendStats(pool, interval)
+			if err != nil {
+				server.logger.Printf("Unable to push stats to %s : %s", pool.id, err)
+			}
+		}
+	}
+}
+
+// sendStats sends a stats control request with the statistics of the pool to its remote Proxy
+// The connection used to send the request is counted as idle, no stats are
+// pushed if no connection is idle rather than waiting in the dispatcher
+func (server *Server) sendStats(pool *Pool, interval time.Duration) (err error) {
+	connection := pool.takeIdle()
+	if connection == nil {
+		return
+	}
+
+	ps := pool.Size()
+	requests := atomic.LoadInt64(&pool.requests)
+	rate := float64(requests-atomic.SwapInt64(&pool.pushed, requests)) / interval.Seconds()
+
+	query := url.Values{}
+	query.Set("idle", strconv.Itoa(ps.Idle+1))
+	query.Set("busy", strconv.Itoa(ps.Busy-1))
+	query.Set("requests", strconv.FormatInt(requests, 10))
+	query.Set("rate", strconv.FormatFloat(rate, 'f', 2, 64))
+	req, err := http.NewRequest("POST", common.ControlScheme+"://control/stats?"+query.Encode(), http.NoBody)
+	if err != nil {
+		connection.Release()
+		return
+	}
+
+	response := newBufferedResponse()
+	err = connection.proxyRequest(response, req)
+	if err != nil {
+		connection.Close(common.CloseError)
+		return
+	}
+	if response.status != http.StatusOK {
+		return fmt.Errorf("Unexpected status %d", response.status)
+	}
+	return
+}
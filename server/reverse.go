@@ -0,0 +1,178 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp/common"
+)
+
+// reverseConnection is a reverse connection of a remote Proxy
+type reverseConnection struct {
+	ws       *websocket.Conn
+	busy     int32         // 1 while a request is executed
+	readDone chan struct{} // closed once the connection stops reading
+}
+
+// isBusy returns true if a request is being executed
+func (rc *reverseConnection) isBusy() bool {
+	return atomic.LoadInt32(&rc.busy) == 1
+}
+
+// addReverse registers the reverse connection, it returns false once the Server is shut down
+func (server *Server) addReverse(rc *reverseConnection) bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	select {
+	case <-server.done:
+		return false
+	default:
+	}
+	server.reverses = append(server.reverses, rc)
+	return true
+}
+
+// removeReverse unregisters the reverse connection
+func (server *Server) removeReverse(rc *reverseConnection) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	var reverses []*reverseConnection
+	for _, r := range server.reverses {
+		if r != rc {
+			reverses = append(reverses, r)
+		}
+	}
+	server.reverses = reverses
+}
+
+// reverse executes the requests sent by a remote Proxy over a reverse connection
+// against the Server network. It uses the same messages as regular connections
+// with the roles swapped : the remote Proxy sends the requests and the Server the responses.
+func (server *Server) reverse(ws *websocket.Conn, settings *common.ClientSettings) {
+	rc := &reverseConnection{ws: ws, readDone: make(chan struct{})}
+	if !server.addReverse(rc) {
+		ws.Close()
+		return
+	}
+	defer server.removeReverse(rc)
+	defer close(rc.readDone)
+	defer ws.Close()
+
+	server.logger.Printf("Reverse connection from %s", settings.ID)
+
+	client := &http.Client{Timeout: server.Config.ReverseTimeout.Duration()}
+
+	for {
+		// Read request, only the body message is not limited
+		ws.SetReadLimit(server.Config.MaxMetadataSize)
+		_, serializedRequest, err := ws.ReadMessage()
+		if err != nil {
+			if _, ok := err.(*websocket.CloseError); !ok {
+				server.logger.Printf("Unable to read reverse request from %s : %s", settings.ID, err)
+			}
+			return
+		}
+		atomic.StoreInt32(&rc.busy, 1)
+
+		// Deserialize request
+		httpRequest := new(common.HTTPRequest)
+		err = common.Unmarshal(settings.Encoding, serializedRequest, httpRequest)
+		if err != nil {
+			server.logger.Printf("Unable to deserialize reverse request from %s : %s", settings.ID, err)
+			return
+		}
+		req, err := common.UnserializeHTTPRequest(httpRequest)
+		if err != nil {
+			server.logger.Printf("Unable to deserialize reverse request from %s : %s", settings.ID, err)
+			return
+		}
+
+		server.logger.Printf("[%s] %s (reverse from %s)", req.Method, req.URL.String(), settings.ID)
+
+		// Pipe request body
+		ws.SetReadLimit(0)
+		_, bodyReader, err := ws.NextReader()
+		if err != nil {
+			server.logger.Printf("Unable to get reverse request body reader : %s", err)
+			return
+		}
+		if settings.Checksum {
+			bodyReader = common.NewChecksumReader(bodyReader)
+		}
+		req.Body = ioutil.NopCloser(bodyReader)
+
+		// Execute request
+		var resp *http.Response
+		if !server.allowReverse(req) {
+			resp = server.errorResponse("Destination is not allowed\n")
+		} else if resp, err = client.Do(req); err != nil {
+			resp = server.errorResponse(fmt.Sprintf("Unable to execute request : %s\n", err))
+		}
+
+		// Write response
+		serializedResponse, err := common.Marshal(settings.Encoding, common.SerializeHTTPResponse(resp))
+		if err != nil {
+			server.logger.Printf("Unable to serialize reverse response : %s", err)
+			resp.Body.Close()
+			return
+		}
+		err = ws.WriteMessage(common.MessageType(settings.Encoding), serializedResponse)
+		if err != nil {
+			server.logger.Printf("Unable to write reverse response : %s", err)
+			resp.Body.Close()
+			return
+		}
+
+		// Pipe response body
+		bodyWriter, err := ws.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			server.logger.Printf("Unable to get reverse response body writer : %s", err)
+			resp.Body.Close()
+			return
+		}
+		if settings.Checksum {
+			bodyWriter = common.NewChecksumWriter(bodyWriter)
+		}
+		_, err = io.Copy(bodyWriter, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			server.logger.Printf("Unable to pipe reverse response body : %s", err)
+			return
+		}
+		err = bodyWriter.Close()
+		if err != nil {
+			server.logger.Printf("Unable to pipe reverse response body (close) : %s", err)
+			return
+		}
+		atomic.StoreInt32(&rc.busy, 0)
+	}
+}
+
+// allowReverse returns true if the request matches one of the reverse whitelist rules
+func (server *Server) allowReverse(req *http.Request) bool {
+	for _, rule := range server.Config.ReverseWhitelist {
+		if rule.Match(req) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorResponse creates a 527 response with the message as body
+func (server *Server) errorResponse(msg string) *http.Response {
+	server.logger.Print(msg)
+	return &http.Response{
+		StatusCode:    527,
+		Header:        make(http.Header),
+		ContentLength: int64(len(msg)),
+		Body:          ioutil.NopCloser(strings.NewReader(msg)),
+	}
+}
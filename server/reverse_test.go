@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp/common"
+)
+
+// TestShutdownReverse checks that Shutdown waits for the running reverse request then closes the reverse connection
+func TestShutdownReverse(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer backend.Close()
+	var releaseOnce sync.Once
+	releaseBackend := func() { releaseOnce.Do(func() { close(release) }) }
+	defer releaseBackend()
+
+	config := NewConfig()
+	rule, err := common.NewRule("", "", nil)
+	if err != nil {
+		t.Fatalf("Unable to create rule : %s", err)
+	}
+	config.ReverseWhitelist = []*common.Rule{rule}
+	server := NewServer(config)
+	server.SetLogOutput(ioutil.Discard)
+
+	// The remote Proxy sends a single request then reads until the connection is closed
+	closed := make(chan struct{})
+	ws, err := newTestWebsockets(t).connect(func(ws *websocket.Conn) {
+		defer close(closed)
+		req, _ := http.NewRequest("GET", backend.URL, nil)
+		serializedRequest, _ := common.Marshal(common.JSONEncoding, common.SerializeHTTPRequest(req))
+		ws.WriteMessage(websocket.TextMessage, serializedRequest)
+		ws.WriteMessage(websocket.BinaryMessage, nil)
+		discardPeer(ws)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.reverse(ws, &common.ClientSettings{ID: "test", Reverse: true})
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("The reverse request was not executed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.waitIdle(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the running reverse request to be waited for, got %v", err)
+	}
+
+	releaseBackend()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Unable to shutdown : %s", err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The reverse connection was not closed")
+	}
+}
@@ -1,14 +1,21 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"net/url"
-	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -19,70 +26,288 @@ import (
 // This is the Server part, Clients will offer websocket connections,
 // those will be pooled to transfer HTTP Request and response
 type Server struct {
-	Config *Config
+	Config     *Config
+	Dispatcher Dispatcher
+
+	// Events receives a RequestEvent per handled request if not nil,
+	// events are dropped if the channel is full
+	Events chan *RequestEvent
+
+	// RequestTransform and ResponseTransform modify the proxied requests and responses if not nil
+	RequestTransform  RequestTransform
+	ResponseTransform ResponseTransform
+
+	// Metrics are exposed on /metrics if not nil, set by NewServer if Config.MetricsEnabled
+	Metrics *Metrics
+
+	// TLSConfig enables HTTPS if not nil, the certificates are loaded from
+	// Config.TLSCertFile and Config.TLSKeyFile if they are set
+	TLSConfig *tls.Config
+
+	logger *log.Logger
 
 	upgrader websocket.Upgrader
 
-	pools []*Pool
-	lock  sync.RWMutex
-	done  chan struct{}
+	pools      []*Pool
+	reverses   []*reverseConnection
+	registered chan struct{} // closed and replaced when a connection is registered
+	lock       sync.RWMutex
+	done       chan struct{}
+
+	connectionRequests chan *ConnectionRequest
+
+	server   *http.Server
+	listener net.Listener
+	ready    chan struct{}
+	serveErr chan error
+
+	resumed   chan struct{}
+	queued    int
+	pauseLock sync.Mutex
+
+	stats *Stats
+
+	started time.Time
+	warm    int32
+
+	coalesced    map[string]*coalescedCall
+	coalesceLock sync.Mutex
+
+	registrations chan struct{}
+	slots         chan struct{} // Proxy requests being processed, limited by Config.MaxConcurrentRequests
+	waiting       int64         // Proxy requests waiting for a slot, limited by Config.RequestQueueSize
+
+	trustedProxies []*net.IPNet
 
-	dispatcher chan *ConnectionRequest
+	upstream *http.Client
 
-	server *http.Server
+	connectionID uint64
+	generation   int64
 }
 
 // ConnectionRequest is used to request a proxy connection from the dispatcher
 type ConnectionRequest struct {
-	connection chan *Connection
-	timeout    <-chan time.Time
+	connection    chan *Connection
+	timeout       chan struct{}
+	contentLength int64
+	poolID        string
 }
 
 // NewConnectionRequest creates a new connection request
-func NewConnectionRequest(timeout time.Duration) (cr *ConnectionRequest) {
+func NewConnectionRequest(timeout time.Duration, contentLength int64) (cr *ConnectionRequest) {
 	cr = new(ConnectionRequest)
 	cr.connection = make(chan *Connection)
 	if timeout > 0 {
-		cr.timeout = time.After(timeout)
+		// The channel is closed rather than sent to so that every
+		// select on it notices the timeout, whatever the retry state
+		cr.timeout = make(chan struct{})
+		time.AfterFunc(timeout, func() { close(cr.timeout) })
 	}
+	cr.contentLength = contentLength
 	return
 }
 
+// Timeout returns a channel closed once the request timed out, it is nil if the request must not wait
+func (cr *ConnectionRequest) Timeout() <-chan struct{} {
+	return cr.timeout
+}
+
+// expired returns true if the request timed out
+func (cr *ConnectionRequest) expired() bool {
+	select {
+	case <-cr.timeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait sleeps for the duration, false is returned if the request timed out meanwhile
+func (cr *ConnectionRequest) wait(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-cr.timeout:
+		return false
+	}
+}
+
+// takeBackoff returns the time to wait after the nth consecutive failure to take a dispatched
+// connection, it is kept short as the other requests wait for the dispatcher meanwhile
+func takeBackoff(failures int) time.Duration {
+	backoff := time.Millisecond << uint(failures-1)
+	if max := 16 * time.Millisecond; backoff > max || backoff <= 0 {
+		return max
+	}
+	return backoff
+}
+
+// ContentLength returns the body size of the request to serve
+func (cr *ConnectionRequest) ContentLength() int64 {
+	return cr.contentLength
+}
+
 // NewServer return a new Server instance
 func NewServer(config *Config) (server *Server) {
-	rand.Seed(time.Now().Unix())
-
 	server = new(Server)
 	server.Config = config
-	server.upgrader = websocket.Upgrader{}
+	server.logger = log.Default()
+	if len(config.RedactQueryParams) > 0 || len(config.RedactPatterns) > 0 {
+		server.logger = log.New(server.redact(log.Writer()), log.Prefix(), log.Flags())
+	}
+	server.generation = time.Now().Unix()
+	server.upgrader = websocket.Upgrader{EnableCompression: config.EnableCompression, Subprotocols: config.Protocols}
+	if len(config.AllowedOrigins) > 0 {
+		server.upgrader.CheckOrigin = server.checkOrigin
+	}
 
 	server.done = make(chan struct{})
-	server.dispatcher = make(chan *ConnectionRequest)
+	server.registered = make(chan struct{})
+	server.ready = make(chan struct{})
+	server.serveErr = make(chan error, 1)
+	if config.MetricsEnabled {
+		server.Metrics = NewMetrics()
+	}
+	server.stats = new(Stats)
+	server.Dispatcher = new(SelectDispatcher)
+	if config.LatencyPollInterval > 0 {
+		server.Dispatcher = NewLatencyDispatcher(rand.NewSource(time.Now().UnixNano()))
+	}
+	server.connectionRequests = make(chan *ConnectionRequest)
+	server.coalesced = make(map[string]*coalescedCall)
+	trustedProxies, err := parseNetworks(config.TrustedProxies)
+	if err != nil {
+		server.logger.Printf("Unable to parse trusted proxies : %s", err)
+	}
+	server.trustedProxies = trustedProxies
+	if config.MaxConcurrentRegistrations > 0 {
+		server.registrations = make(chan struct{}, config.MaxConcurrentRegistrations)
+	}
+	if config.MaxConcurrentRequests > 0 {
+		server.slots = make(chan struct{}, config.MaxConcurrentRequests)
+	}
+	server.upstream = newUpstreamClient(config.UpstreamTimeout.Duration())
 	return
 }
 
 // Start Server HTTP server
-func (server *Server) Start() {
+// An error is returned if the certificates can't be loaded or the address can't be bound
+func (server *Server) Start() (err error) {
+	r := http.NewServeMux()
+	r.HandleFunc("/request", server.limited(server.request))
+	r.HandleFunc("/register", server.register)
+	r.HandleFunc("/status", server.readOnly(server.status))
+	r.HandleFunc("/healthz", server.healthz)
+	r.HandleFunc("/readyz", server.readyz)
+	if server.Metrics != nil {
+		r.HandleFunc("/metrics", server.readOnly(server.metrics))
+	}
+	r.HandleFunc("/version", server.version)
+	r.HandleFunc("/admin/pool", server.admin(server.setPoolIdleSize))
+	r.HandleFunc("/admin/connections", server.admin(server.connections))
+	r.HandleFunc("/admin/connection/retire", server.admin(server.retireConnection))
+	r.HandleFunc("/", server.limited(server.grpc))
+
+	if server.Config.Pprof {
+		r.HandleFunc("/debug/pprof/", server.admin(pprof.Index))
+		r.HandleFunc("/debug/pprof/cmdline", server.admin(pprof.Cmdline))
+		r.HandleFunc("/debug/pprof/profile", server.admin(pprof.Profile))
+		r.HandleFunc("/debug/pprof/symbol", server.admin(pprof.Symbol))
+		r.HandleFunc("/debug/pprof/trace", server.admin(pprof.Trace))
+	}
+
+	server.server = &http.Server{Addr: server.Config.Host + ":" + strconv.Itoa(server.Config.Port), Handler: r, ErrorLog: server.logger}
+	if server.Config.H2C {
+		// gRPC clients connect using HTTP/2 with prior knowledge
+		server.server.Protocols = new(http.Protocols)
+		server.server.Protocols.SetHTTP1(true)
+		server.server.Protocols.SetUnencryptedHTTP2(true)
+		server.server.Protocols.SetHTTP2(true)
+	}
+
+	// Load the certificates now so that errors are returned to the caller
+	tlsConfig := server.TLSConfig
+	if server.Config.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(server.Config.TLSCertFile, server.Config.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("Unable to load TLS certificate : %s", err)
+		}
+		if tlsConfig == nil {
+			tlsConfig = new(tls.Config)
+		} else {
+			tlsConfig = tlsConfig.Clone()
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+	server.server.TLSConfig = tlsConfig
+
+	listenConfig := net.ListenConfig{KeepAlive: time.Duration(server.Config.TCPKeepAlive) * time.Millisecond}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", server.server.Addr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen on %s : %s", server.server.Addr, err)
+	}
+	server.listener = listener
+
 	go func() {
 		for {
 			select {
 			case <-server.done:
-				break
+				return
 			case <-time.After(5 * time.Second):
 				server.clean()
 			}
 		}
 	}()
 
-	r := http.NewServeMux()
-	r.HandleFunc("/request", server.request)
-	r.HandleFunc("/register", server.register)
-	r.HandleFunc("/status", server.status)
+	server.started = time.Now()
 
 	go server.dispatchConnections()
 
-	server.server = &http.Server{Addr: server.Config.Host + ":" + strconv.Itoa(server.Config.Port), Handler: r}
-	go func() { log.Fatal(server.server.ListenAndServe()) }()
+	if server.Config.LatencyPollInterval > 0 {
+		go server.pollLatency()
+	}
+
+	if server.Config.StatsPushInterval > 0 {
+		go server.pushStats()
+	}
+
+	// Notify that the server is accepting connections
+	close(server.ready)
+
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = server.server.ServeTLS(listener, "", "")
+		} else {
+			err = server.server.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
+			server.logger.Printf("HTTP server error : %s", err)
+			server.serveErr <- err
+		}
+	}()
+
+	return
+}
+
+// Err returns a channel that receives the error if the HTTP server stops unexpectedly
+// Nothing is sent when the server is shut down
+func (server *Server) Err() <-chan error {
+	return server.serveErr
+}
+
+// Ready returns a channel that is closed once the HTTP server is accepting connections
+func (server *Server) Ready() <-chan struct{} {
+	return server.ready
+}
+
+// Addr returns the address the HTTP server listens on, useful if Config.Port is 0
+// It is nil until Start returns
+func (server *Server) Addr() net.Addr {
+	if server.listener == nil {
+		return nil
+	}
+	return server.listener.Addr()
 }
 
 // clean remove empty Pools
@@ -99,19 +324,21 @@ func (server *Server) clean() {
 
 	var pools []*Pool
 	for _, pool := range server.pools {
+		// Holding server.lock ensures that no place is reserved in
+		// the pool between IsEmpty and Shutdown
 		if pool.IsEmpty() {
-			log.Printf("Removing empty connection pool : %s", pool.id)
+			server.logger.Printf("Removing empty connection pool : %s", pool.id)
 			pool.Shutdown()
-		} else {
-			pools = append(pools, pool)
+			continue
 		}
+		pools = append(pools, pool)
 
 		ps := pool.Size()
 		idle += ps.Idle
 		busy += ps.Busy
 	}
 
-	log.Printf("%d pools, %d idle, %d busy", len(pools), idle, busy)
+	server.logger.Printf("%d pools, %d idle, %d busy", len(pools), idle, busy)
 
 	server.pools = pools
 }
@@ -120,61 +347,72 @@ func (server *Server) clean() {
 func (server *Server) dispatchConnections() {
 	for {
 		// A client requests a connection
-		request, ok := <-server.dispatcher
-		if !ok {
+		var request *ConnectionRequest
+		select {
+		case request = <-server.connectionRequests:
+		case <-server.done:
 			// Shutdown
-			break
+			return
 		}
 
+		failedTakes := 0
 		for {
-			server.lock.RLock()
-
-			if len(server.pools) == 0 {
-				// No connection pool available
-				server.lock.RUnlock()
+			// The request timeout is authoritative
+			if request.expired() {
 				break
 			}
 
-			// Build a select statement dynamically
-			cases := make([]reflect.SelectCase, len(server.pools)+1)
+			server.lock.RLock()
 
-			// Add all pools idle connection channel
-			for i, ch := range server.pools {
-				cases[i] = reflect.SelectCase{
-					Dir:  reflect.SelectRecv,
-					Chan: reflect.ValueOf(ch.idle)}
+			// Only keep the pools able to handle the request
+			var pools []*Pool
+			for _, pool := range server.pools {
+				if pool.CanHandle(request) {
+					pools = append(pools, pool)
+				}
 			}
 
-			// Add timeout channel
-			if request.timeout != nil {
-				cases[len(cases)-1] = reflect.SelectCase{
-					Dir:  reflect.SelectRecv,
-					Chan: reflect.ValueOf(request.timeout)}
-			} else {
-				cases[len(cases)-1] = reflect.SelectCase{
-					Dir: reflect.SelectDefault}
+			if len(pools) == 0 {
+				// No connection pool available
+				registered := server.registered
+				server.lock.RUnlock()
+
+				// Wait for a remote Proxy to register within the request timeout
+				if server.Config.WaitForPool && request.timeout != nil {
+					select {
+					case <-registered:
+						continue
+					case <-request.timeout:
+					}
+				}
+				break
 			}
 
 			server.lock.RUnlock()
 
 			// This call blocks
-			chosen, value, ok := reflect.Select(cases)
-
-			if chosen == len(cases)-1 {
+			connection := server.Dispatcher.Dispatch(pools, request)
+			if connection == nil {
 				// a timeout occured
 				break
 			}
-			if !ok {
-				// a proxy pool has been removed, try again
-				continue
-			}
-			connection, _ := value.Interface().(*Connection)
 
 			// Verify that we can use this connection
 			if connection.Take() {
 				request.connection <- connection
 				break
 			}
+
+			// Dispatched connections closed or taken concurrently, back off
+			// to avoid spinning and give up after Config.MaxTakeRetries
+			failedTakes++
+			if max := server.Config.MaxTakeRetries; max > 0 && failedTakes > max {
+				server.logger.Printf("Giving up acquiring a connection after %d failed attempts", failedTakes)
+				break
+			}
+			if !request.wait(takeBackoff(failedTakes)) {
+				break
+			}
 		}
 
 		close(request.connection)
@@ -183,26 +421,62 @@ func (server *Server) dispatchConnections() {
 
 // This is the way for clients to execute HTTP requests through an Proxy
 func (server *Server) request(w http.ResponseWriter, r *http.Request) {
+	w, r, emit := server.startEvent(w, r)
+	defer emit()
+
 	// Parse destination URL
 	dstURL := r.Header.Get("X-PROXY-DESTINATION")
 	if dstURL == "" {
-		common.ProxyErrorf(w, "Missing X-PROXY-DESTINATION header")
+		server.proxyErrorf(w, "Missing X-PROXY-DESTINATION header")
 		return
 	}
 	URL, err := url.Parse(dstURL)
 	if err != nil {
-		common.ProxyErrorf(w, "Unable to parse X-PROXY-DESTINATION header")
+		server.proxyErrorf(w, "Unable to parse X-PROXY-DESTINATION header")
 		return
 	}
 	r.URL = URL
 
-	log.Printf("[%s] %s", r.Method, r.URL.String())
+	// Let the embedder modify or reject the request, the rules apply to the modified request
+	if server.RequestTransform != nil {
+		err = server.RequestTransform(r)
+		if err != nil {
+			server.proxyErrorf(w, "Request rejected : %s", err)
+			return
+		}
+	}
+	if r.URL.Scheme == common.ControlScheme {
+		server.proxyErrorf(w, "Invalid X-PROXY-DESTINATION scheme")
+		return
+	}
+	if !server.isAllowedScheme(r.URL.Scheme) {
+		server.proxyErrorf(w, "Destination scheme %q is not allowed", r.URL.Scheme)
+		return
+	}
+
+	// Reject requests looping through the Server
+	err = server.checkLoop(r)
+	if errors.Is(err, errLoop) {
+		server.proxyErrorStatus(w, http.StatusLoopDetected, err)
+		return
+	}
+	if err != nil {
+		server.proxyErrorStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	server.logger.Printf("[%s] %s", r.Method, r.URL.String())
+
+	// Count the requests by tenant
+	if tenant := r.Header.Get("X-PROXY-TENANT"); tenant != "" && server.Config.MaxTenants > 0 {
+		server.stats.tenantRequest(tenant, server.Config.MaxTenants)
+	}
 
 	// Apply blacklist
 	if len(server.Config.Blacklist) > 0 {
 		for _, rule := range server.Config.Blacklist {
 			if rule.Match(r) {
-				common.ProxyErrorf(w, "Destination is forbidden")
+				server.proxyErrorf(w, "Destination is forbidden")
 				return
 			}
 		}
@@ -218,103 +492,820 @@ func (server *Server) request(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		if !allowed {
-			common.ProxyErrorf(w, "Destination is not allowed")
+			server.proxyErrorf(w, "Destination is not allowed")
 			return
 		}
 	}
 
-	if len(server.pools) == 0 {
-		common.ProxyErrorf(w, "No proxy available")
+	// Validate multipart bodies while they are forwarded
+	stopValidation := server.checkMultipart(r)
+	defer stopValidation()
+
+	// Forward the original client IP to the backend
+	server.setForwardedFor(r)
+
+	// Hold the request while dispatching is paused
+	err = server.waitResume(r.Context())
+	if err != nil {
+		server.proxyError(w, err)
 		return
 	}
 
-	// Get a proxy connection
-	request := NewConnectionRequest(time.Duration(server.Config.Timeout) * time.Millisecond)
-	server.dispatcher <- request
-	connection := <-request.connection
-	if connection == nil {
-		common.ProxyErrorf(w, "Unable to get a proxy connection")
+	if len(server.pools) == 0 && server.Config.Upstream == "" && !server.Config.WaitForPool {
+		server.failure(w, FailureNoPool, errors.New("No proxy available"))
+		return
+	}
+
+	// Share the response of identical concurrent GET requests
+	if server.Config.Coalesce && r.Method == "GET" {
+		server.coalesce(w, r)
+		return
+	}
+
+	// Spool large uploads to disk
+	cleanup, err := server.spool(r)
+	if err != nil {
+		server.proxyError(w, err)
+		return
+	}
+	defer cleanup()
+
+	server.forward(w, r)
+}
+
+// forward executes the request through one of the remote Proxies
+func (server *Server) forward(w http.ResponseWriter, r *http.Request) {
+	// Fail fast requests don't wait for a connection to be released
+	timeout := server.requestTimeout(r)
+	failFast := server.Config.FailFast || r.Header.Get("X-PROXY-FAIL-FAST") == "true"
+	if failFast {
+		timeout = 0
+	}
+
+	// Get a proxy connection, from the remote Proxy of the X-PROXY-CLIENT-ID header if any
+	request := NewConnectionRequest(timeout, r.ContentLength)
+	request.poolID = r.Header.Get("X-PROXY-CLIENT-ID")
+	connection, err := server.getConnection(request)
+	if err != nil {
+		// Let the upstream Server handle requests no local remote Proxy can serve
+		if server.Config.Upstream != "" {
+			server.forwardUpstream(w, r)
+			return
+		}
+		if request.poolID != "" {
+			server.lock.RLock()
+			pool := server.getPool(request.poolID)
+			server.lock.RUnlock()
+			if pool == nil {
+				server.failure(w, FailureNoPool, fmt.Errorf("No remote Proxy with client ID %s", request.poolID))
+				return
+			}
+			err = fmt.Errorf("%s from client %s", err, request.poolID)
+		}
+		if failFast {
+			server.logger.Println(err)
+			http.Error(w, "No idle connection available", http.StatusServiceUnavailable)
+			return
+		}
+		server.failure(w, FailureTimeout, err)
 		return
 	}
 
+	setEventPool(r, connection.pool)
+	atomic.AddInt64(&connection.pool.requests, 1)
+
 	// Send the request to the proxy
+	start := time.Now()
 	err = connection.proxyRequest(w, r)
+	server.Metrics.request(time.Since(start))
 	if err != nil {
+		atomic.AddInt64(&server.stats.TunnelErrors, 1)
+
+		// The websocket is still in a consistent state, keep the connection
+		if _, ok := err.(*RecoverableError); ok {
+			connection.Release()
+			server.failure(w, FailureProtocol, err)
+			return
+		}
+
+		// The request body is rejected mid-stream, throw the connection away
+		// but don't blame the remote Proxy
+		if _, ok := err.(*InvalidBodyError); ok {
+			connection.Close(common.CloseError)
+			server.proxyError(w, err)
+			return
+		}
+
 		// An error occurred throw the connection away
-		log.Println(err)
-		connection.Close()
+		server.logger.Println(err)
+		connection.Close(common.CloseError)
+		connection.pool.breaker.Failure()
+
+		// Response headers have already been sent, abort the response
+		// so that the client doesn't mistake it for a complete one
+		if _, ok := err.(*TruncatedResponseError); ok {
+			server.Metrics.failure(FailureProtocol)
+			panic(http.ErrAbortHandler)
+		}
+
+		// Nothing has been sent to the client yet, replay spooled bodies once through another
+		// connection unless the remote Proxy may have executed a non idempotent request
+		_, unsent := err.(*UnsentRequestError)
+		if getBody := r.GetBody; getBody != nil && (unsent || isIdempotent(r.Method)) {
+			r.GetBody = nil
+			if body, err := getBody(); err == nil {
+				server.logger.Println("Retrying request with the spooled body")
+				r.Body = body
+				server.forward(w, r)
+				return
+			}
+		}
 
 		// Try to return an error to the client
 		// This might fail if response headers have already been sent
-		common.ProxyError(w, err)
+		server.failure(w, FailureProtocol, err)
+	}
+}
+
+// isAllowedScheme returns true if the destination scheme is in Config.AllowedSchemes
+func (server *Server) isAllowedScheme(scheme string) bool {
+	for _, allowed := range server.Config.AllowedSchemes {
+		if strings.EqualFold(scheme, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestTimeout returns the X-PROXY-TIMEOUT header timeout if it is valid and doesn't
+// exceed Config.MaxTimeout, Config.Timeout otherwise
+func (server *Server) requestTimeout(r *http.Request) time.Duration {
+	header := r.Header.Get("X-PROXY-TIMEOUT")
+	if header == "" {
+		return server.Config.Timeout.Duration()
+	}
+	ms, err := strconv.Atoi(header)
+	if err != nil || ms <= 0 || common.Milliseconds(ms) > server.Config.MaxTimeout {
+		server.logger.Printf("Ignoring invalid X-PROXY-TIMEOUT header %q", header)
+		return server.Config.Timeout.Duration()
+	}
+	return common.Milliseconds(ms).Duration()
+}
+
+// gRPC clients can't choose the request path, the method path is appended
+// to the X-PROXY-DESTINATION header which must be the backend base URL
+func (server *Server) grpc(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") || r.Header.Get("X-PROXY-DESTINATION") == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	r.Header.Set("X-PROXY-DESTINATION", strings.TrimSuffix(r.Header.Get("X-PROXY-DESTINATION"), "/")+r.URL.Path)
+	server.request(w, r)
+}
+
+// getConnection requests a proxy connection from the dispatcher
+func (server *Server) getConnection(request *ConnectionRequest) (connection *Connection, err error) {
+	start := time.Now()
+	for {
+		if request.poolID != "" {
+			// Requests for a given remote Proxy don't wait in the dispatcher
+			// so that a busy pool can't starve the other pools
+			connection = server.takePoolConnection(request)
+		} else if request.timeout == nil {
+			// Fail fast requests don't wait for the dispatcher to be available
+			select {
+			case server.connectionRequests <- request:
+				connection = <-request.connection
+			default:
+				connection = server.takeIdleConnection(request)
+			}
+		} else {
+			select {
+			case server.connectionRequests <- request:
+			case <-request.timeout:
+				// The dispatcher is busy with previous requests
+				server.stats.acquisition(time.Since(start), time.Duration(server.Config.AcquisitionWaitThreshold)*time.Millisecond, false)
+				return nil, errors.New("Unable to get a proxy connection")
+			case <-server.done:
+				return nil, errors.New("Server is shutting down")
+			}
+			connection = <-request.connection
+		}
+		if connection == nil {
+			break
+		}
+
+		// Discard silently dead connections and try another one
+		if server.Config.ProbeTimeout <= 0 || connection.probe(time.Duration(server.Config.ProbeTimeout)*time.Millisecond) {
+			break
+		}
+		connection.Close(common.CloseProbeFailed)
+		request.connection = make(chan *Connection)
+	}
+	server.stats.acquisition(time.Since(start), time.Duration(server.Config.AcquisitionWaitThreshold)*time.Millisecond, connection != nil)
+	if connection == nil {
+		return nil, errors.New("Unable to get a proxy connection")
+	}
+	return
+}
+
+// takeIdleConnection takes an idle connection of a pool able to handle the request
+// without going through the dispatcher, it returns nil if no connection is idle
+func (server *Server) takeIdleConnection(request *ConnectionRequest) *Connection {
+	server.lock.RLock()
+	var pools []*Pool
+	for _, pool := range server.pools {
+		if pool.CanHandle(request) {
+			pools = append(pools, pool)
+		}
+	}
+	server.lock.RUnlock()
+
+	for _, pool := range pools {
+		if connection := pool.takeIdle(); connection != nil {
+			return connection
+		}
+	}
+	return nil
+}
+
+// takePoolConnection takes an idle connection of the pool of request.poolID without going
+// through the dispatcher, it waits for one to be offered until the request timeout expires
+// It returns nil if the pool doesn't exist or can't handle the request
+func (server *Server) takePoolConnection(request *ConnectionRequest) *Connection {
+	server.lock.RLock()
+	pool := server.getPool(request.poolID)
+	server.lock.RUnlock()
+	if pool == nil || !pool.CanHandle(request) {
+		return nil
+	}
+
+	if request.timeout == nil {
+		return pool.takeIdle()
+	}
+	for {
+		select {
+		case connection := <-pool.idle:
+			if connection.Take() {
+				return connection
+			}
+		case <-request.timeout:
+			return nil
+		case <-pool.shutdown:
+			return nil
+		case <-server.done:
+			return nil
+		}
 	}
 }
 
 // This is the way for wsp clients to offer websocket connections
 func (server *Server) register(w http.ResponseWriter, r *http.Request) {
+	// Reject unauthorized clients before upgrading the connection
 	secretKey := r.Header.Get("X-SECRET-KEY")
 	if secretKey != server.Config.SecretKey {
-		common.ProxyErrorf(w, "Invalid X-SECRET-KEY")
+		server.logger.Printf("Invalid X-SECRET-KEY from %s", r.RemoteAddr)
+		http.Error(w, "Invalid X-SECRET-KEY", http.StatusUnauthorized)
+		return
+	}
+
+	// Queue registrations exceeding Config.MaxConcurrentRegistrations to smooth reconnect storms
+	if server.registrations != nil {
+		select {
+		case server.registrations <- struct{}{}:
+			defer func() { <-server.registrations }()
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	// The highest subprotocol supported by both sides is selected by the upgrader
+	// Clients that don't request a subprotocol speak wsp.v1
+	if !server.supportsProtocol(websocket.Subprotocols(r)) {
+		server.logger.Printf("Unsupported protocols %v from %s", websocket.Subprotocols(r), r.RemoteAddr)
+		http.Error(w, "Unsupported protocol", http.StatusBadRequest)
 		return
 	}
 
 	ws, err := server.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		common.ProxyErrorf(w, "HTTP upgrade error : %v", err)
+		server.proxyErrorf(w, "HTTP upgrade error : %v", err)
 		return
 	}
 
-	// The first message should contains the remote Proxy name and size
+	// The first message should contains the remote Proxy settings
+	ws.SetReadLimit(server.Config.MaxMetadataSize)
 	_, greeting, err := ws.ReadMessage()
 	if err != nil {
-		common.ProxyErrorf(w, "Unable to read greeting message : %s", err)
+		server.proxyErrorf(w, "Unable to read greeting message : %s", err)
 		ws.Close()
 		return
 	}
 
+	// Body messages are not limited, response messages are limited by readMetadata()
+	ws.SetReadLimit(0)
+
 	// Parse the greeting message
-	split := strings.Split(string(greeting), "_")
-	id := split[0]
-	size, err := strconv.Atoi(split[1])
+	settings, err := common.ParseGreeting(greeting, common.NegotiatedProtocol(ws.Subprotocol()))
 	if err != nil {
-		common.ProxyErrorf(w, "Unable to parse greeting message : %s", err)
-		ws.Close()
+		server.logger.Printf("Unable to parse greeting message : %s", err)
+		server.rejectConnection(ws, "Unable to parse greeting message")
+		return
+	}
+	if settings.ID == "" {
+		server.rejectConnection(ws, "Missing client ID")
+		return
+	}
+	if settings.PoolSize <= 0 {
+		server.rejectConnection(ws, fmt.Sprintf("Invalid pool size %d, must be positive", settings.PoolSize))
+		return
+	}
+	if !common.IsValidEncoding(settings.Encoding) {
+		server.rejectConnection(ws, "Unsupported encoding")
+		return
+	}
+
+	// Reverse connections carry requests from the remote Proxy to the Server network
+	if settings.Reverse {
+		if len(server.Config.ReverseWhitelist) == 0 {
+			server.rejectConnection(ws, "Reverse requests are disabled")
+			return
+		}
+		err = acknowledgeGreeting(ws)
+		if err != nil {
+			server.logger.Printf("Unable to acknowledge greeting message : %s", err)
+			ws.Close()
+			return
+		}
+		go server.reverse(ws, settings)
 		return
 	}
 
 	server.lock.Lock()
-	defer server.lock.Unlock()
 
 	// Get that client's Pool
-	var pool *Pool
-	for _, p := range server.pools {
-		if p.id == id {
-			pool = p
-			break
+	pool := server.getPool(settings.ID)
+	if pool == nil {
+		pool = NewPool(server, settings.ID)
+		server.pools = append(server.pools, pool)
+	}
+
+	// update pool settings
+	pool.setSettings(settings)
+
+	// Reserve a place in the pool for the connection
+	err = pool.reserve()
+	server.lock.Unlock()
+	if err != nil {
+		server.rejectConnection(ws, err.Error())
+		return
+	}
+
+	// Add the ws to the pool, no lock is held while the greeting is acknowledged
+	err = pool.Register(ws, settings)
+	if err != nil {
+		server.rejectConnection(ws, err.Error())
+		return
+	}
+
+	// Notify the requests waiting for a pool
+	server.lock.Lock()
+	close(server.registered)
+	server.registered = make(chan struct{})
+	server.lock.Unlock()
+}
+
+// supportsProtocol returns true if one of the requested subprotocols is enabled
+func (server *Server) supportsProtocol(protocols []string) bool {
+	if len(protocols) == 0 {
+		return common.HasProtocol(server.Config.Protocols, common.ProtocolV1)
+	}
+	for _, protocol := range protocols {
+		if common.HasProtocol(server.Config.Protocols, protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+// acknowledgeGreeting notifies the remote Proxy that the greeting message is accepted
+// Remote Proxies speaking wsp.v1 don't expect an acknowledgment
+func acknowledgeGreeting(ws *websocket.Conn) (err error) {
+	if common.NegotiatedProtocol(ws.Subprotocol()) == common.ProtocolV1 {
+		return
+	}
+	ws.SetWriteDeadline(time.Now().Add(time.Second))
+	err = ws.WriteMessage(websocket.TextMessage, []byte(common.GreetingAck))
+	ws.SetWriteDeadline(time.Time{})
+	return
+}
+
+// getPool returns the Pool of the remote Proxy or nil
+// This MUST be surrounded by server.lock.Lock()
+func (server *Server) getPool(id string) *Pool {
+	for _, pool := range server.pools {
+		if pool.id == id {
+			return pool
 		}
 	}
+	return nil
+}
+
+// setPoolIdleSize updates the number of idle connections a remote Proxy keeps open
+func (server *Server) setPoolIdleSize(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	size, err := strconv.Atoi(r.URL.Query().Get("idlesize"))
+	if err != nil || size <= 0 {
+		http.Error(w, "Invalid idlesize", http.StatusBadRequest)
+		return
+	}
+
+	server.lock.Lock()
+	pool := server.getPool(id)
+	if pool != nil && pool.Settings().Control {
+		settings := *pool.Settings()
+		settings.PoolSize = size
+		pool.setSettings(&settings)
+	}
+	server.lock.Unlock()
+
 	if pool == nil {
-		pool = NewPool(server, id)
-		server.pools = append(server.pools, pool)
+		http.Error(w, "Unknown pool", http.StatusNotFound)
+		return
+	}
+	if !pool.Settings().Control {
+		http.Error(w, "The remote Proxy doesn't handle control requests", http.StatusNotImplemented)
+		return
+	}
+
+	server.logger.Printf("Setting idle size of pool %s to %d", id, size)
+
+	// Notify the remote Proxy so that it opens new idle connections
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s://control/pool?idlesize=%d", common.ControlScheme, size), http.NoBody)
+	if err != nil {
+		server.proxyError(w, err)
+		return
+	}
+
+	request := NewConnectionRequest(server.Config.Timeout.Duration(), 0)
+	request.poolID = id
+	connection, err := server.getConnection(request)
+	if err != nil {
+		server.proxyError(w, err)
+		return
+	}
+
+	err = connection.proxyRequest(w, req)
+	if err != nil {
+		server.logger.Println(err)
+		connection.Close(common.CloseError)
+		server.proxyError(w, err)
+	}
+}
+
+// ConnectionInfo describes a connection of the /admin/connections endpoint
+type ConnectionInfo struct {
+	ID       uint64
+	Pool     string
+	Status   string
+	Requests int
+	Protocol string
+}
+
+// connections lists the connections of every pool
+func (server *Server) connections(w http.ResponseWriter, r *http.Request) {
+	infos := make([]*ConnectionInfo, 0)
+
+	server.lock.RLock()
+	for _, pool := range server.pools {
+		pool.lock.RLock()
+		for _, connection := range pool.connections {
+			connection.lock.Lock()
+			info := &ConnectionInfo{ID: connection.id, Pool: pool.id, Requests: connection.requests, Protocol: connection.protocol}
+			switch connection.status {
+			case IDLE:
+				info.Status = "idle"
+			case BUSY:
+				info.Status = "busy"
+			default:
+				info.Status = "closed"
+			}
+			connection.lock.Unlock()
+			infos = append(infos, info)
+		}
+		pool.lock.RUnlock()
+	}
+	server.lock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// retireConnection closes a single connection once its current request is done
+func (server *Server) retireConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+
+	var connection *Connection
+	server.lock.RLock()
+	for _, pool := range server.pools {
+		pool.lock.RLock()
+		for _, c := range pool.connections {
+			if c.id == id {
+				connection = c
+			}
+		}
+		pool.lock.RUnlock()
 	}
+	server.lock.RUnlock()
 
-	// update pool size
-	pool.size = size
+	if connection == nil {
+		http.Error(w, "Unknown connection", http.StatusNotFound)
+		return
+	}
 
-	// Add the ws to the pool
-	pool.Register(ws)
+	connection.logf("Retiring connection")
+	connection.Retire()
+}
+
+// checkOrigin accepts websocket handshakes without Origin header ( non browser clients )
+// or from one of the Config.AllowedOrigins
+func (server *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range server.Config.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	server.logger.Printf("Origin %s is not allowed", origin)
+	return false
+}
+
+// rejectConnection sends a close message with the reason to the remote Proxy and closes the websocket
+func (server *Server) rejectConnection(ws *websocket.Conn, reason string) {
+	server.logger.Printf("Rejecting connection : %s", reason)
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(time.Second))
+	ws.Close()
+}
+
+// admin restricts the access of the handler to requests with a valid X-ADMIN-KEY
+// Admin endpoints are disabled if no admin key is configured
+func (server *Server) admin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminKey := r.Header.Get("X-ADMIN-KEY")
+		if server.Config.AdminKey == "" || adminKey != server.Config.AdminKey {
+			http.Error(w, "Invalid X-ADMIN-KEY", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// readOnly restricts the access of the handler to requests with a valid X-STATUS-KEY
+// or X-ADMIN-KEY if a status key is configured
+func (server *Server) readOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if server.Config.StatusKey != "" {
+			statusKey := r.Header.Get("X-STATUS-KEY")
+			adminKey := r.Header.Get("X-ADMIN-KEY")
+			if statusKey != server.Config.StatusKey && (server.Config.AdminKey == "" || adminKey != server.Config.AdminKey) {
+				http.Error(w, "Invalid X-STATUS-KEY", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler(w, r)
+	}
 }
 
 func (server *Server) status(w http.ResponseWriter, r *http.Request) {
+	if !server.isWarm() {
+		http.Error(w, "Waiting for remote Proxies to connect", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Plain text health checks
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "text/plain") && !strings.Contains(accept, "application/json") {
+		w.Write([]byte("ok"))
+		return
+	}
+
+	// Filter the pools of large fleets with ?pool=ID and ?name=NAME
+	stats := server.Stats()
+	stats.filter(r.URL.Query().Get("pool"), r.URL.Query().Get("name"))
+	if r.URL.Query().Get("runtime") != "" {
+		stats.Runtime = readRuntimeStats()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&StatusReport{SchemaVersion: StatusReportVersion, Stats: stats})
+}
+
+// healthz answers ok once the Server is warm, unlike /status it doesn't require the status key
+func (server *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	if !server.isWarm() {
+		http.Error(w, "Waiting for remote Proxies to connect", http.StatusServiceUnavailable)
+		return
+	}
 	w.Write([]byte("ok"))
 }
 
-// Shutdown stop the Server
-func (server *Server) Shutdown() {
+// readyz answers ok while the remote Proxies keep at least Config.MinIdleConnections idle connections
+// Unlike /healthz it fails again whenever the idle connections drop below the minimum
+func (server *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	if !server.isWarm() {
+		http.Error(w, "Waiting for remote Proxies to connect", http.StatusServiceUnavailable)
+		return
+	}
+
+	if min := server.Config.MinIdleConnections; min > 0 {
+		server.lock.RLock()
+		idle := 0
+		for _, pool := range server.pools {
+			idle += pool.Size().Idle
+		}
+		server.lock.RUnlock()
+
+		if idle < min {
+			http.Error(w, fmt.Sprintf("Not ready : %d idle connections ( min %d )", idle, min), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("ok"))
+}
+
+// isWarm returns true once Config.MinConnections connections have been registered
+// or Config.WarmupTimeout elapsed since the Server started
+func (server *Server) isWarm() bool {
+	if atomic.LoadInt32(&server.warm) == 1 {
+		return true
+	}
+
+	warm := server.Config.MinConnections <= 0 || time.Since(server.started) > time.Duration(server.Config.WarmupTimeout)*time.Millisecond
+	if !warm {
+		server.lock.RLock()
+		connections := 0
+		for _, pool := range server.pools {
+			ps := pool.Size()
+			connections += ps.Idle + ps.Busy
+		}
+		server.lock.RUnlock()
+		warm = connections >= server.Config.MinConnections
+	}
+
+	if warm {
+		atomic.StoreInt32(&server.warm, 1)
+	}
+	return warm
+}
+
+// Stats returns a snapshot of the Server statistics
+func (server *Server) Stats() (stats *Stats) {
+	stats = server.stats.Snapshot()
+
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+
+	stats.Clients = make(map[string]string)
+	stats.Pools = make(map[string]*PoolStats)
+	for _, pool := range server.pools {
+		settings := pool.Settings()
+		stats.Clients[pool.id] = settings.Version
+		ps := pool.Size()
+		stats.Pools[pool.id] = &PoolStats{
+			ID:      pool.id,
+			Name:    settings.Name,
+			Version: settings.Version,
+			Idle:    ps.Idle,
+			Busy:    ps.Busy,
+			Closed:  ps.Closed,
+			Total:   ps.Idle + ps.Busy + ps.Closed,
+			Latency: atomic.LoadInt64(&pool.latency),
+		}
+	}
+	stats.sumPools()
+	return
+}
+
+// version returns the build version and commit of the Server
+func (server *Server) version(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&common.BuildInfo{Version: common.Version, Commit: common.Commit})
+}
+
+// Pause holds incoming requests instead of dispatching them until Resume is called
+// At most Config.PauseQueueSize requests are held, the following ones are rejected
+func (server *Server) Pause() {
+	server.pauseLock.Lock()
+	defer server.pauseLock.Unlock()
+
+	if server.resumed == nil {
+		server.logger.Println("Pausing dispatch")
+		server.resumed = make(chan struct{})
+	}
+}
+
+// Resume dispatching and release the held requests
+func (server *Server) Resume() {
+	server.pauseLock.Lock()
+	defer server.pauseLock.Unlock()
+
+	if server.resumed != nil {
+		server.logger.Printf("Resuming dispatch, releasing %d requests", server.queued)
+		close(server.resumed)
+		server.resumed = nil
+	}
+}
+
+// Wait for dispatching to be resumed if it is paused
+func (server *Server) waitResume(ctx context.Context) error {
+	server.pauseLock.Lock()
+	resumed := server.resumed
+	if resumed == nil {
+		server.pauseLock.Unlock()
+		return nil
+	}
+	if server.queued >= server.Config.PauseQueueSize {
+		server.pauseLock.Unlock()
+		return errors.New("Dispatching is paused and the queue is full")
+	}
+	server.queued++
+	server.pauseLock.Unlock()
+
+	defer func() {
+		server.pauseLock.Lock()
+		server.queued--
+		server.pauseLock.Unlock()
+	}()
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stop the Server gracefully
+// It stops accepting new requests and waits for the in-flight requests to complete
+// and every connection to be idle or for the context to expire before closing all
+// connections, reverse connections included, connections still busy are closed anyway
+func (server *Server) Shutdown(ctx context.Context) (err error) {
+	if server.server != nil {
+		err = server.server.Shutdown(ctx)
+	}
+
+	// Connections may be busy without HTTP handler ( latency polls, admin control requests, ... )
+	if err == nil {
+		err = server.waitIdle(ctx)
+	}
+	if err != nil {
+		server.logger.Printf("Closing busy connections : %s", err)
+	}
+
 	close(server.done)
-	close(server.dispatcher)
+
+	server.lock.Lock()
 	for _, pool := range server.pools {
 		pool.Shutdown()
 	}
+	for _, rc := range server.reverses {
+		go common.CloseWebsocket(rc.ws, rc.readDone)
+	}
+	server.lock.Unlock()
+
 	server.clean()
+	return
+}
+
+// waitIdle waits for every connection to be idle or the context to expire
+func (server *Server) waitIdle(ctx context.Context) error {
+	for {
+		busy := 0
+		server.lock.RLock()
+		for _, pool := range server.pools {
+			busy += pool.Size().Busy
+		}
+		for _, rc := range server.reverses {
+			if rc.isBusy() {
+				busy++
+			}
+		}
+		server.lock.RUnlock()
+		if busy == 0 {
+			return nil
+		}
+
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
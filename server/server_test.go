@@ -0,0 +1,489 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/root-gg/wsp/client"
+	"github.com/root-gg/wsp/common"
+)
+
+// newTestServer starts a Server listening on a random port, it is shut down at the end of the test
+func newTestServer(t testing.TB, config *Config) *Server {
+	t.Helper()
+
+	config.Port = 0
+	server := NewServer(config)
+	server.SetLogOutput(ioutil.Discard)
+	startTestServer(t, server)
+	return server
+}
+
+// startTestServer starts the server, it is shut down at the end of the test
+func startTestServer(t testing.TB, server *Server) {
+	t.Helper()
+
+	err := server.Start()
+	if err != nil {
+		t.Fatalf("Unable to start server : %s", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+}
+
+// newTestClient starts a Client connected to the server and waits for its idle connections
+// It is shut down at the end of the test
+func newTestClient(t testing.TB, server *Server, config *client.Config) *client.Client {
+	t.Helper()
+
+	config.Targets = []string{"ws://" + server.Addr().String() + "/register"}
+	c := client.NewClient(config)
+	c.SetLogOutput(ioutil.Discard)
+	c.Start()
+	t.Cleanup(c.Shutdown)
+
+	waitIdleConnections(t, server, config.PoolIdleSize)
+	return c
+}
+
+// waitIdleConnections waits for the server to have at least n idle connections
+func waitIdleConnections(t testing.TB, server *Server, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Stats().Totals.Idle < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Client connections not registered in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newTestClientConfig returns a client configuration with a small pool
+func newTestClientConfig() *client.Config {
+	config := client.NewConfig()
+	config.PoolIdleSize = 2
+	config.PoolMaxSize = 10
+	return config
+}
+
+// writerFunc is an io.Writer calling the function
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// proxy sends a request to the backend URL through the server
+func proxy(t testing.TB, server *Server, method string, url string, body io.Reader) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, "http://"+server.Addr().String()+"/request", body)
+	if err != nil {
+		t.Fatalf("Unable to create request : %s", err)
+	}
+	req.Header.Set("X-PROXY-DESTINATION", url)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unable to proxy request : %s", err)
+	}
+	return resp
+}
+
+func TestStartReady(t *testing.T) {
+	server := newTestServer(t, NewConfig())
+
+	select {
+	case <-server.Ready():
+	default:
+		t.Fatal("Server is not ready once Start returned")
+	}
+
+	resp, err := http.Get("http://" + server.Addr().String() + "/version")
+	if err != nil {
+		t.Fatalf("Unable to reach the server : %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d", resp.StatusCode)
+	}
+}
+
+func TestStartListenError(t *testing.T) {
+	first := newTestServer(t, NewConfig())
+
+	config := NewConfig()
+	config.Port = first.Addr().(*net.TCPAddr).Port
+	server := NewServer(config)
+	server.SetLogOutput(ioutil.Discard)
+	if err := server.Start(); err == nil {
+		t.Fatal("Start should fail when the address is already in use")
+	}
+
+	select {
+	case <-server.Ready():
+		t.Fatal("Server should not be ready if it can't listen")
+	default:
+	}
+}
+
+func TestProxyMethods(t *testing.T) {
+	methods := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods <- r.Method
+		w.Write([]byte(r.Method))
+	}))
+	defer backend.Close()
+
+	server := newTestServer(t, NewConfig())
+	newTestClient(t, server, newTestClientConfig())
+
+	for _, method := range []string{"GET", "POST", "PATCH", "PROPFIND", "MKCOL", "X-CUSTOM"} {
+		resp := proxy(t, server, method, backend.URL+"/resource", nil)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s : unexpected status %d : %s", method, resp.StatusCode, body)
+		}
+		if received := <-methods; received != method {
+			t.Fatalf("%s : backend received %s", method, received)
+		}
+		if string(body) != method {
+			t.Fatalf("%s : unexpected body %q", method, body)
+		}
+	}
+}
+
+func TestProxyChunkedUpload(t *testing.T) {
+	type upload struct {
+		contentLength    int64
+		transferEncoding []string
+		body             string
+	}
+	uploads := make(chan upload, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		uploads <- upload{r.ContentLength, r.TransferEncoding, string(body)}
+	}))
+	defer backend.Close()
+
+	body := strings.Repeat("chunk", 10000)
+	for _, bufferRequestSize := range []int64{0, 1 << 20} {
+		server := newTestServer(t, NewConfig())
+		config := newTestClientConfig()
+		config.BufferRequestSize = bufferRequestSize
+		newTestClient(t, server, config)
+
+		// The body length is unknown so the request is sent chunked
+		resp := proxy(t, server, "PUT", backend.URL, ioutil.NopCloser(strings.NewReader(body)))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status %d", resp.StatusCode)
+		}
+
+		received := <-uploads
+		if received.body != body {
+			t.Fatalf("Backend received %d bytes instead of %d", len(received.body), len(body))
+		}
+		if bufferRequestSize == 0 {
+			if received.contentLength != -1 || len(received.transferEncoding) == 0 || received.transferEncoding[0] != "chunked" {
+				t.Fatalf("Expected a chunked upload, got Content-Length %d and Transfer-Encoding %v", received.contentLength, received.transferEncoding)
+			}
+		} else if received.contentLength != int64(len(body)) {
+			t.Fatalf("Expected a buffered upload of %d bytes, got Content-Length %d", len(body), received.contentLength)
+		}
+	}
+}
+
+func TestInjectedRequestFailure(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	server := newTestServer(t, NewConfig())
+	c := newTestClient(t, server, newTestClientConfig())
+
+	c.FailNextRequest()
+	resp := proxy(t, server, "GET", backend.URL, nil)
+	resp.Body.Close()
+	if resp.StatusCode != server.statusCode(FailureDial) {
+		t.Fatalf("Expected the injected failure status %d, got %d", server.statusCode(FailureDial), resp.StatusCode)
+	}
+
+	// The failure is injected once, the next request goes through another connection
+	resp = proxy(t, server, "GET", backend.URL, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d after the injected failure", resp.StatusCode)
+	}
+}
+
+func TestInjectedConnectFailure(t *testing.T) {
+	server := newTestServer(t, NewConfig())
+
+	config := newTestClientConfig()
+	config.Targets = []string{"ws://" + server.Addr().String() + "/register"}
+	c := client.NewClient(config)
+	var failed int32
+	c.SetLogOutput(writerFunc(func(p []byte) (int, error) {
+		if bytes.Contains(p, []byte("Injected connection failure")) {
+			atomic.StoreInt32(&failed, 1)
+		}
+		return len(p), nil
+	}))
+	c.FailNextConnect()
+	c.Start()
+	defer c.Shutdown()
+
+	// The client connects again after the injected failure
+	waitIdleConnections(t, server, config.PoolIdleSize)
+	if atomic.LoadInt32(&failed) == 0 {
+		t.Fatal("No connection failure was injected")
+	}
+}
+
+func TestTakeBackoff(t *testing.T) {
+	for failures, backoff := range map[int]time.Duration{
+		1:   time.Millisecond,
+		2:   2 * time.Millisecond,
+		5:   16 * time.Millisecond,
+		6:   16 * time.Millisecond,
+		100: 16 * time.Millisecond,
+	} {
+		if got := takeBackoff(failures); got != backoff {
+			t.Errorf("takeBackoff(%d) = %s, expected %s", failures, got, backoff)
+		}
+	}
+}
+
+// busyDispatcher always dispatches a connection which can't be taken
+type busyDispatcher struct {
+	dispatches int32
+}
+
+func (dispatcher *busyDispatcher) Dispatch(pools []*Pool, request *ConnectionRequest) *Connection {
+	atomic.AddInt32(&dispatcher.dispatches, 1)
+	return &Connection{status: BUSY}
+}
+
+func TestMaxTakeRetries(t *testing.T) {
+	config := NewConfig()
+	config.Port = 0
+	config.MaxTakeRetries = 3
+	server := NewServer(config)
+	server.SetLogOutput(ioutil.Discard)
+	dispatcher := new(busyDispatcher)
+	server.Dispatcher = dispatcher
+	startTestServer(t, server)
+	newTestClient(t, server, newTestClientConfig())
+
+	start := time.Now()
+	resp := proxy(t, server, "GET", "http://backend/", nil)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("The request should fail when no dispatched connection can be taken")
+	}
+	if dispatches := atomic.LoadInt32(&dispatcher.dispatches); dispatches != 4 {
+		t.Fatalf("Expected 4 dispatches, got %d", dispatches)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("The request took %s to fail", elapsed)
+	}
+}
+
+func TestTakePoolConnectionWaitsForIdle(t *testing.T) {
+	pool := newTestPool(t, NewConfig())
+	server := pool.server
+	server.pools = append(server.pools, pool)
+	connection := newTestConnection(t, pool, discardPeer)
+
+	// The only connection of the pool is busy for a while
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		connection.Release()
+	}()
+
+	request := NewConnectionRequest(time.Second, 0)
+	request.poolID = pool.id
+	if taken := server.takePoolConnection(request); taken != connection {
+		t.Fatalf("Expected the released connection, got %v", taken)
+	}
+
+	// Nothing is released before the timeout
+	request = NewConnectionRequest(50*time.Millisecond, 0)
+	request.poolID = pool.id
+	start := time.Now()
+	if taken := server.takePoolConnection(request); taken != nil {
+		t.Fatal("A busy connection was taken")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("Gave up after %s, before the request timeout", elapsed)
+	}
+
+	// Unknown pools fail at once
+	request = NewConnectionRequest(time.Second, 0)
+	request.poolID = "unknown"
+	if taken := server.takePoolConnection(request); taken != nil {
+		t.Fatal("A connection of another pool was taken")
+	}
+}
+
+func TestClientReload(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	server := newTestServer(t, NewConfig())
+	config := newTestClientConfig()
+	c := newTestClient(t, server, config)
+
+	// Reload while requests are served and the pool idle size is overridden
+	c.SetPoolIdleSize(3)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			reloaded := newTestClientConfig()
+			reloaded.Targets = config.Targets
+			reloaded.MaxConnsPerHost = i + 1
+			c.Reload(reloaded)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		resp := proxy(t, server, "GET", backend.URL, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status %d", resp.StatusCode)
+		}
+	}
+	<-done
+
+	if size := c.Settings().PoolSize; size != 3 {
+		t.Fatalf("Pool idle size override lost by the reload, got %d", size)
+	}
+	if id := c.Config().ID; id != config.ID {
+		t.Fatalf("Client ID changed by the reload from %s to %s", config.ID, id)
+	}
+
+	// The rules of the new configuration apply to the next requests
+	rule, err := common.NewRule("", backend.URL+".*", nil)
+	if err != nil {
+		t.Fatalf("Unable to create rule : %s", err)
+	}
+	reloaded := newTestClientConfig()
+	reloaded.Targets = config.Targets
+	reloaded.Blacklist = []*common.Rule{rule}
+	c.Reload(reloaded)
+
+	resp := proxy(t, server, "GET", backend.URL, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "Destination is forbidden") {
+		t.Fatalf("Blacklist not applied after reload : %d %s", resp.StatusCode, body)
+	}
+}
+
+// testSignature signs the request like AWS SigV4 : the lowercased and sorted signed headers,
+// the host and a hash of the body. The header order and name casing don't matter.
+func testSignature(method string, path string, host string, header http.Header, body []byte) string {
+	signed := []string{"host", "user-agent", "x-amz-content-sha256", "x-amz-date"}
+	canonical := method + "\n" + path + "\n"
+	for _, name := range signed {
+		value := header.Get(name)
+		if name == "host" {
+			value = host
+		}
+		canonical += name + ":" + strings.TrimSpace(value) + "\n"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonical += strings.Join(signed, ";") + "\n" + hex.EncodeToString(bodyHash[:])
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestProxySignedRequest(t *testing.T) {
+	type received struct {
+		header    http.Header
+		host      string
+		body      []byte
+		signature string
+	}
+	requests := make(chan *received, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- &received{
+			header:    r.Header,
+			host:      r.Host,
+			body:      body,
+			signature: testSignature(r.Method, r.URL.Path, r.Host, r.Header, body),
+		}
+	}))
+	defer backend.Close()
+	backendHost := strings.TrimPrefix(backend.URL, "http://")
+
+	server := newTestServer(t, NewConfig())
+	config := newTestClientConfig()
+	config.PreserveHeaders = true
+	newTestClient(t, server, config)
+
+	// Don't let the HTTP client of the test add default headers either
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableCompression = true
+	httpClient := &http.Client{Transport: transport}
+
+	for _, userAgent := range []string{"aws-sdk-go/1.0", ""} {
+		body := []byte(`{"Action":"PutItem"}`)
+		req, err := http.NewRequest("POST", "http://"+server.Addr().String()+"/request", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Unable to create request : %s", err)
+		}
+		req.Header.Set("X-PROXY-DESTINATION", backend.URL+"/items")
+		req.Header.Set("User-Agent", userAgent)
+		req.Header.Set("X-Amz-Date", "20261015T000000Z")
+		bodyHash := sha256.Sum256(body)
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(bodyHash[:]))
+		signature := testSignature("POST", "/items", backendHost, req.Header, body)
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unable to proxy request : %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status %d", resp.StatusCode)
+		}
+
+		r := <-requests
+		if r.signature != signature {
+			t.Fatalf("User-Agent %q : signature doesn't validate on the backend", userAgent)
+		}
+		if r.host != backendHost {
+			t.Fatalf("Backend received Host %s, expected %s", r.host, backendHost)
+		}
+		if r.header.Get("User-Agent") != userAgent {
+			t.Fatalf("Backend received User-Agent %q, expected %q", r.header.Get("User-Agent"), userAgent)
+		}
+		if encoding, ok := r.header["Accept-Encoding"]; ok {
+			t.Fatalf("Backend received Accept-Encoding %q", encoding)
+		}
+		if !bytes.Equal(r.body, body) {
+			t.Fatalf("Backend received body %q, expected %q", r.body, body)
+		}
+	}
+}
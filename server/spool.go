@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// spool copies request bodies larger than Config.SpoolThreshold, or of unknown size, to a
+// temporary file. The upload is then complete before a websocket connection is acquired
+// and the body can be replayed with r.GetBody. The returned function removes the file.
+// Bodies larger than Config.SpoolMaxSize are streamed and can't be replayed.
+func (server *Server) spool(r *http.Request) (cleanup func(), err error) {
+	cleanup = func() {}
+
+	threshold := server.Config.SpoolThreshold
+	if threshold <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	if r.ContentLength >= 0 && r.ContentLength <= threshold {
+		return
+	}
+	maxSize := server.Config.SpoolMaxSize
+	if maxSize > 0 && r.ContentLength > maxSize {
+		return
+	}
+
+	file, err := ioutil.TempFile(server.Config.SpoolDir, "wsp-spool-")
+	if err != nil {
+		return cleanup, fmt.Errorf("Unable to create spool file : %s", err)
+	}
+	remove := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	body := r.Body
+	if maxSize > 0 {
+		body = ioutil.NopCloser(io.LimitReader(r.Body, maxSize+1))
+	}
+	size, err := io.Copy(file, body)
+	if err != nil {
+		remove()
+		return cleanup, fmt.Errorf("Unable to spool request body : %s", err)
+	}
+
+	// Chunked bodies exceeding the maximum size, stream the rest after the spooled part
+	if maxSize > 0 && size > maxSize {
+		r.Body = ioutil.NopCloser(io.MultiReader(io.NewSectionReader(file, 0, size), r.Body))
+		return remove, nil
+	}
+
+	r.ContentLength = size
+	r.TransferEncoding = nil
+	r.Body = ioutil.NopCloser(io.NewSectionReader(file, 0, size))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.NewSectionReader(file, 0, size)), nil
+	}
+	return remove, nil
+}
+
+// isIdempotent returns true if executing the request twice has the same effect as once
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
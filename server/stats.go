@@ -0,0 +1,160 @@
+package server
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatusReportVersion is the version of the StatusReport schema, fields may be added
+// within a version but it is incremented when a field is removed or changes meaning
+const StatusReportVersion = 1
+
+// StatusReport is the JSON document returned by /status, every field is always present
+type StatusReport struct {
+	SchemaVersion int
+	*Stats
+}
+
+// Stats are the Server connection acquisition statistics
+type Stats struct {
+	Acquisitions       int64
+	FailedAcquisitions int64
+	SlowAcquisitions   int64 // Acquisitions that waited more than Config.AcquisitionWaitThreshold
+	MaxAcquisitionWait int64 // milliseconds
+	TunnelErrors       int64 // Requests that failed to go through the websocket
+	BackendErrors      int64 // Responses with a 5xx status, including remote Proxy failures to reach the backend ( 527 )
+
+	Tenants map[string]int64 // Requests by X-PROXY-TENANT header, see Config.MaxTenants
+
+	Clients map[string]string     // Version of the connected remote Proxies by id
+	Pools   map[string]*PoolStats // Connections of the remote Proxies by id
+	Totals  PoolTotals            // Connections of all the Pools
+
+	Runtime *RuntimeStats // Only set if requested as it stops the world
+
+	tenantLock sync.Mutex
+}
+
+// OtherTenant counts the requests of the tenants above Config.MaxTenants
+const OtherTenant = "other"
+
+// tenantRequest counts a request of the tenant, at most max tenants are
+// tracked to bound the cardinality, the others are counted as OtherTenant
+func (stats *Stats) tenantRequest(tenant string, max int) {
+	stats.tenantLock.Lock()
+	defer stats.tenantLock.Unlock()
+
+	if stats.Tenants == nil {
+		stats.Tenants = make(map[string]int64)
+	}
+	if _, ok := stats.Tenants[tenant]; !ok && len(stats.Tenants) >= max {
+		tenant = OtherTenant
+	}
+	stats.Tenants[tenant]++
+}
+
+// RuntimeStats are the Go runtime statistics of the Server process
+type RuntimeStats struct {
+	Goroutines int
+	HeapInuse  uint64 // bytes
+	HeapAlloc  uint64 // bytes
+	NumGC      uint32
+}
+
+// readRuntimeStats collects the runtime statistics
+// runtime.ReadMemStats stops the world so it is only done on demand
+func readRuntimeStats() *RuntimeStats {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	return &RuntimeStats{
+		Goroutines: runtime.NumGoroutine(),
+		HeapInuse:  memStats.HeapInuse,
+		HeapAlloc:  memStats.HeapAlloc,
+		NumGC:      memStats.NumGC,
+	}
+}
+
+// PoolStats are the statistics of the connections of a remote Proxy
+type PoolStats struct {
+	ID      string
+	Name    string
+	Version string
+	Idle    int
+	Busy    int
+	Closed  int // Closed connections not cleaned yet
+	Total   int
+	Latency int64 // Median backend latency reported by the remote Proxy in milliseconds, -1 if unknown
+}
+
+// PoolTotals are the connection counts summed over the pools
+type PoolTotals struct {
+	Pools  int
+	Idle   int
+	Busy   int
+	Closed int
+	Total  int
+}
+
+// sumPools computes the Totals of the Pools
+func (stats *Stats) sumPools() {
+	stats.Totals = PoolTotals{Pools: len(stats.Pools)}
+	for _, pool := range stats.Pools {
+		stats.Totals.Idle += pool.Idle
+		stats.Totals.Busy += pool.Busy
+		stats.Totals.Closed += pool.Closed
+		stats.Totals.Total += pool.Total
+	}
+}
+
+// filter keeps the pools with the id and client name, an empty value matches any pool
+func (stats *Stats) filter(id string, name string) {
+	for poolID, pool := range stats.Pools {
+		if (id != "" && poolID != id) || (name != "" && pool.Name != name) {
+			delete(stats.Pools, poolID)
+			delete(stats.Clients, poolID)
+		}
+	}
+	stats.sumPools()
+}
+
+// acquisition records the time a request waited to acquire a connection
+func (stats *Stats) acquisition(wait time.Duration, threshold time.Duration, success bool) {
+	if success {
+		atomic.AddInt64(&stats.Acquisitions, 1)
+	} else {
+		atomic.AddInt64(&stats.FailedAcquisitions, 1)
+	}
+
+	if threshold > 0 && wait > threshold {
+		atomic.AddInt64(&stats.SlowAcquisitions, 1)
+	}
+
+	ms := int64(wait / time.Millisecond)
+	for {
+		max := atomic.LoadInt64(&stats.MaxAcquisitionWait)
+		if ms <= max || atomic.CompareAndSwapInt64(&stats.MaxAcquisitionWait, max, ms) {
+			break
+		}
+	}
+}
+
+// Snapshot returns a consistent copy of the statistics
+func (stats *Stats) Snapshot() (snapshot *Stats) {
+	snapshot = new(Stats)
+	snapshot.Acquisitions = atomic.LoadInt64(&stats.Acquisitions)
+	snapshot.FailedAcquisitions = atomic.LoadInt64(&stats.FailedAcquisitions)
+	snapshot.SlowAcquisitions = atomic.LoadInt64(&stats.SlowAcquisitions)
+	snapshot.MaxAcquisitionWait = atomic.LoadInt64(&stats.MaxAcquisitionWait)
+	snapshot.TunnelErrors = atomic.LoadInt64(&stats.TunnelErrors)
+	snapshot.BackendErrors = atomic.LoadInt64(&stats.BackendErrors)
+
+	snapshot.Tenants = make(map[string]int64)
+	stats.tenantLock.Lock()
+	for tenant, requests := range stats.Tenants {
+		snapshot.Tenants[tenant] = requests
+	}
+	stats.tenantLock.Unlock()
+	return
+}
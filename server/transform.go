@@ -0,0 +1,19 @@
+package server
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/root-gg/wsp/common"
+)
+
+// RequestTransform is called with the request to proxy before it is checked against the rules
+// and dispatched, r.URL is the parsed X-PROXY-DESTINATION header. It can modify the request
+// ( headers, destination, ... ) or return an error to reject it.
+type RequestTransform func(r *http.Request) error
+
+// ResponseTransform is called with the response of the remote Proxy before it is written
+// back to the caller. It can modify the response status and headers and return a function
+// wrapping the response body to rewrite it ( or nil to leave the body untouched ), in that
+// case the response is sent without Content-Length as the body size may change.
+type ResponseTransform func(r *http.Request, response *common.HTTPResponse) (wrapBody func(io.Reader) io.Reader)
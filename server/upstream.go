@@ -0,0 +1,55 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/root-gg/wsp/common"
+)
+
+// newUpstreamClient creates the http.Client forwarding requests to the upstream Server
+// Redirects are returned as is to the caller like any other proxied response
+func newUpstreamClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// forwardUpstream proxies a request no local remote Proxy can serve to the upstream Server
+func (server *Server) forwardUpstream(w http.ResponseWriter, r *http.Request) {
+	server.logger.Printf("Forwarding request to upstream %s", server.Config.Upstream)
+
+	req, err := http.NewRequest(r.Method, server.Config.Upstream, r.Body)
+	if err != nil {
+		server.proxyErrorf(w, "Unable to create upstream request : %s", err)
+		return
+	}
+	req = req.WithContext(r.Context())
+	req.Header = common.RemoveHopHeaders(r.Header)
+	req.Header.Set("X-PROXY-DESTINATION", r.URL.String())
+	req.ContentLength = r.ContentLength
+
+	resp, err := server.upstream.Do(req)
+	if err != nil {
+		server.proxyErrorf(w, "Unable to forward request to upstream : %s", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	for header, values := range common.RemoveHopHeaders(resp.Header) {
+		for _, value := range values {
+			w.Header().Add(header, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		server.logger.Printf("Unable to pipe upstream response body : %s", err)
+		panic(http.ErrAbortHandler)
+	}
+}
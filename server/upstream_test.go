@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/root-gg/wsp/common"
+)
+
+func TestForwardUpstreamHopHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+		w.Header().Set("Connection", "X-Upstream-Hop")
+		w.Header().Set("X-Upstream-Hop", "1")
+		w.Header().Set("X-Upstream", "1")
+	}))
+	defer upstream.Close()
+
+	config := NewConfig()
+	config.Upstream = upstream.URL
+	server := newTestServer(t, config)
+
+	req, err := http.NewRequest("GET", "http://"+server.Addr().String()+"/request", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request : %s", err)
+	}
+	req.Header.Set("X-PROXY-DESTINATION", "http://backend/")
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "secret")
+	req.Header.Set("X-Client", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unable to proxy request : %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d", resp.StatusCode)
+	}
+	header := <-received
+	for _, name := range []string{"X-Client-Hop", "Proxy-Authorization"} {
+		if header.Get(name) != "" {
+			t.Fatalf("Hop-by-hop header %s forwarded to upstream", name)
+		}
+	}
+	if header.Get("X-Client") == "" || header.Get("X-PROXY-DESTINATION") != "http://backend/" {
+		t.Fatalf("Missing end-to-end headers in upstream request %v", header)
+	}
+	if resp.Header.Get("X-Upstream-Hop") != "" {
+		t.Fatal("Hop-by-hop header of the upstream response forwarded to the client")
+	}
+	if resp.Header.Get("X-Upstream") == "" {
+		t.Fatal("Missing end-to-end header in the response")
+	}
+}
+
+func TestForwardUpstreamTimeout(t *testing.T) {
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	config := NewConfig()
+	config.Upstream = upstream.URL
+	config.UpstreamTimeout = common.Milliseconds(100)
+	server := newTestServer(t, config)
+
+	start := time.Now()
+	resp := proxy(t, server, "GET", "http://backend/", nil)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("The request should fail when the upstream Server doesn't answer")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("The request took %s to fail", elapsed)
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -23,6 +25,14 @@ func header(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("hello world in header\n"))
 }
 
+func headers(w http.ResponseWriter, r *http.Request) {
+	count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+	for i := 0; i < count; i++ {
+		w.Header().Add(fmt.Sprintf("X-Header-%d", i), "value")
+	}
+	w.Write([]byte("hello world in headers\n"))
+}
+
 func post(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -36,6 +46,39 @@ func post(w http.ResponseWriter, r *http.Request) {
 	w.Write(body)
 }
 
+func method(w http.ResponseWriter, r *http.Request) {
+	log.Println("method", r.Method)
+	w.Write([]byte(r.Method + "\n"))
+}
+
+func truncate(w http.ResponseWriter, r *http.Request) {
+	log.Println("truncate")
+	w.Header().Set("Content-Length", "1000")
+	w.Write([]byte("truncated"))
+}
+
+func trailer(w http.ResponseWriter, r *http.Request) {
+	log.Println("trailer")
+	w.Header().Set("Trailer", "Grpc-Status")
+	w.Write([]byte("hello world with trailer\n"))
+	w.Header().Set("Grpc-Status", "0")
+}
+
+func length(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+	}
+	log.Println("length", r.ContentLength, r.TransferEncoding)
+	fmt.Fprintf(w, "Content-Length %d, Transfer-Encoding %v, %d bytes read\n", r.ContentLength, r.TransferEncoding, len(body))
+}
+
+func connectionClose(w http.ResponseWriter, r *http.Request) {
+	log.Println("close")
+	w.Header().Set("Connection", "close")
+	w.Write([]byte("hello world with connection close\n"))
+}
+
 func fail(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "GO FUNK YOURSELF", 666)
 }
@@ -45,13 +88,28 @@ func sleep(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("ok"))
 }
 
+func stall(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Length", "12")
+	w.Write([]byte("hello "))
+	w.(http.Flusher).Flush()
+	time.Sleep(10 * time.Second)
+	w.Write([]byte("world\n"))
+}
+
 func main() {
 	flag.Parse()
 	log.SetFlags(0)
 	http.HandleFunc("/hello", hello)
 	http.HandleFunc("/header", header)
+	http.HandleFunc("/headers", headers)
 	http.HandleFunc("/fail", fail)
 	http.HandleFunc("/post", post)
+	http.HandleFunc("/method", method)
+	http.HandleFunc("/truncate", truncate)
+	http.HandleFunc("/trailer", trailer)
+	http.HandleFunc("/length", length)
+	http.HandleFunc("/close", connectionClose)
 	http.HandleFunc("/sleep", sleep)
+	http.HandleFunc("/stall", stall)
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/root-gg/utils"
 
@@ -36,6 +37,22 @@ func main() {
 		}
 	}()
 
+	// Handle SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			<-hup
+			log.Println("SIGHUP Detected, reloading configuration")
+			config, err := client.LoadConfiguration(*configFile)
+			if err != nil {
+				log.Printf("Unable to reload configuration : %s", err)
+				continue
+			}
+			proxy.Reload(config)
+		}
+	}()
+
 	proxy.Start()
 
 	select {}
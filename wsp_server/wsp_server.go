@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/root-gg/utils"
 
@@ -24,19 +27,43 @@ func main() {
 
 	server := server.NewServer(config)
 
-	// Handle SIGINT
+	// Handle SIGINT / SIGTERM
+	// Wait at most ShutdownTimeout for in-flight requests to complete
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		log.Printf("%s Detected", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout)*time.Millisecond)
+		defer cancel()
+
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Printf("Unable to shutdown gracefully : %s", err)
+		}
+		os.Exit(0)
+	}()
+
+	// Handle SIGUSR1 / SIGUSR2 to pause / resume dispatching
+	usr := make(chan os.Signal, 1)
+	signal.Notify(usr, syscall.SIGUSR1, syscall.SIGUSR2)
 	go func() {
 		for {
-			<-c
-			log.Println("SIGINT Detected")
-			server.Shutdown()
-			os.Exit(0)
+			if <-usr == syscall.SIGUSR1 {
+				server.Pause()
+			} else {
+				server.Resume()
+			}
 		}
 	}()
 
-	server.Start()
+	err = server.Start()
+	if err != nil {
+		log.Fatalf("Unable to start server : %s", err)
+	}
 
-	select {}
+	// The process exits from the signal handler once shut down
+	err = <-server.Err()
+	log.Fatalf("Server stopped : %s", err)
 }